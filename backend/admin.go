@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin checks the request carries "Authorization: Bearer <ADMIN_TOKEN>" and writes
+// an error if not. Admin endpoints are disabled entirely when ADMIN_TOKEN is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		handleError(w, newError(ErrForbidden, "admin endpoints disabled"))
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		handleError(w, newError(ErrUnauthorized, "unauthorized"))
+		return false
+	}
+	return true
+}
+
+// requireUploadToken checks an upload request carries "Authorization: Bearer <UPLOAD_TOKEN>"
+// and writes an error if not. Uploads are open when UPLOAD_TOKEN is unset; reads never need
+// it. Only the requests that start an upload check it: a presign confirmation or resumable
+// PATCH is authorized by the ID handed out in response.
+func requireUploadToken(w http.ResponseWriter, r *http.Request) bool {
+	token := os.Getenv("UPLOAD_TOKEN")
+	if token == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		handleError(w, newError(ErrUnauthorized, "upload token required"))
+		return false
+	}
+	return true
+}
+
+// reindexDiff summarizes a reindex: how the feed index changed and what was done to the
+// photos table to match the bucket.
+type reindexDiff struct {
+	Count    int      `json:"count"`    // photos in the feed afterwards
+	Added    []string `json:"added"`    // keys newly in the feed
+	Removed  []string `json:"removed"`  // keys no longer in the feed
+	Inserted int      `json:"inserted"` // photo records written for unrecorded objects
+	Missing  []string `json:"missing"`  // records marked missing: their objects are gone
+	Restored []string `json:"restored"` // missing records whose objects are back
+}
+
+// reindex re-lists the buckets, then reconciles the photos table with the result.
+func (s *server) reindex(ctx context.Context) (reindexDiff, error) {
+	s.feedByKeyMu.RLock()
+	before := make(map[string]bool, len(s.feedByKey))
+	for k := range s.feedByKey {
+		before[k] = true
+	}
+	s.feedByKeyMu.RUnlock()
+	diff := reindexDiff{Added: []string{}, Removed: []string{}}
+	var err error
+	if diff.Count, err = s.rebuildFeed(ctx); err != nil {
+		return diff, err
+	}
+	s.feedByKeyMu.RLock()
+	for k := range s.feedByKey {
+		if !before[k] {
+			diff.Added = append(diff.Added, k)
+		}
+		delete(before, k)
+	}
+	s.feedByKeyMu.RUnlock()
+	for k := range before {
+		diff.Removed = append(diff.Removed, k)
+	}
+	slices.Sort(diff.Added)
+	slices.Sort(diff.Removed)
+	if diff.Inserted, err = s.backfillPhotos(ctx); err != nil {
+		return diff, wrapError(ErrInternal, "reindex failed", err)
+	}
+	if diff.Missing, diff.Restored, err = s.reconcilePhotos(ctx); err != nil {
+		return diff, wrapError(ErrInternal, "reindex failed", err)
+	}
+	slices.Sort(diff.Missing)
+	slices.Sort(diff.Restored)
+	return diff, nil
+}
+
+// handleReindex serves POST /admin/reindex: it rebuilds the feed index from the buckets and
+// brings the photos table in line, reporting the differences found.
+func (s *server) handleReindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	v, err, shared := s.reindexGroup.Do("reindex", func() (interface{}, error) {
+		return s.reindex(context.Background())
+	})
+	if err != nil {
+		var ae *apiError
+		if !errors.As(err, &ae) {
+			err = s.r2Error("reindex failed", err)
+		}
+		handleError(w, err)
+		return
+	}
+	diff := v.(reindexDiff)
+	log.Printf("reindex complete: count=%d added=%d removed=%d inserted=%d missing=%d restored=%d shared=%t",
+		diff.Count, len(diff.Added), len(diff.Removed), diff.Inserted, len(diff.Missing), len(diff.Restored), shared)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// handleBackfillExif starts reading EXIF capture times for indexed JPEGs that lack one (see
+// backfillTakenAt). It runs in the background; a second call while one is running joins it.
+func (s *server) handleBackfillExif(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	go s.reindexGroup.Do("backfill-exif", func() (interface{}, error) {
+		n := s.backfillTakenAt(context.Background())
+		log.Printf("exif backfill complete: updated=%d", n)
+		return n, nil
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"ok": "started"})
+}
+
+// decodeDeleteKeys reads a batch delete body: an array of keys or {"keys": [...]}.
+func decodeDeleteKeys(r *http.Request) ([]string, error) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, newError(ErrValidation, "invalid JSON: expected an array of keys")
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err == nil {
+		return keys, nil
+	}
+	var obj struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, newError(ErrValidation, "invalid JSON: expected an array of keys")
+	}
+	return obj.Keys, nil
+}
+
+// handleDeleteBatch serves /admin/delete-batch and /admin/photos/delete: it deletes many
+// photos at once, the objects with DeleteObjects and their rows in one transaction, and
+// reports per-key results.
+func (s *server) handleDeleteBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	keys, err := decodeDeleteKeys(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if len(keys) == 0 {
+		handleError(w, newError(ErrValidation, "keys required"))
+		return
+	}
+	// Entries may be photo IDs; results report the key each resolved to.
+	for i, k := range keys {
+		keys[i] = s.resolvePhoto(k)
+	}
+	results, deleted := s.deletePhotos(r.Context(), keys)
+	log.Printf("batch delete: requested=%d deleted=%d", len(keys), len(deleted))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// handleVoteReasons serves GET /admin/vote-reasons: the votes that came with a reason, most
+// recently updated first. ?limit caps how many (default 50, at most 1000).
+func (s *server) handleVoteReasons(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT key, namu_is_tuxedo, reason, updated_at
+		FROM votes
+		WHERE reason IS NOT NULL
+		ORDER BY updated_at DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "vote reasons failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	defer rows.Close()
+	type voteReason struct {
+		Key          string    `json:"key"`
+		NamuIsTuxedo bool      `json:"namu_is_tuxedo"`
+		Reason       string    `json:"reason"`
+		UpdatedAt    time.Time `json:"updated_at"`
+	}
+	reasons := []voteReason{}
+	for rows.Next() {
+		var vr voteReason
+		if err := rows.Scan(&vr.Key, &vr.NamuIsTuxedo, &vr.Reason, &vr.UpdatedAt); err != nil {
+			handleError(w, wrapError(ErrInternal, "vote reasons failed", fmt.Errorf("scan: %w", err)))
+			return
+		}
+		reasons = append(reasons, vr)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, wrapError(ErrInternal, "vote reasons failed", fmt.Errorf("rows: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"reasons": reasons})
+}
+
+// handleMaintenance serves POST /admin/maintenance (body: {"enabled": bool}), turning
+// maintenance mode on or off. The flag lives only in memory: a restart starts it again from
+// MAINTENANCE_MODE.
+func (s *server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON"))
+		return
+	}
+	s.maintenance.Store(req.Enabled)
+	log.Printf("maintenance mode set: enabled=%t", req.Enabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": req.Enabled})
+}
+
+// handlePhotoAdmin serves POST /admin/photos/{key}/{action}. The actions are hide, unhide,
+// pin and unpin, plus approve and reject for pending uploads. {key} may also be a photo ID.
+// Keys can contain slashes (albums), so the action is taken from the end of the path.
+func (s *server) handlePhotoAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/photos/")
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	key, action := s.resolvePhoto(rest[:i]), rest[i+1:]
+	switch action {
+	case "hide":
+		if _, err := s.db.ExecContext(r.Context(),
+			`INSERT INTO hidden_photos (photo_key) VALUES ($1) ON CONFLICT (photo_key) DO NOTHING`, key); err != nil {
+			handleError(w, wrapError(ErrInternal, "hide failed", err))
+			return
+		}
+		s.removeFromFeed([]string{key})
+	case "unhide":
+		if _, err := s.db.ExecContext(r.Context(), `DELETE FROM hidden_photos WHERE photo_key = $1`, key); err != nil {
+			handleError(w, wrapError(ErrInternal, "unhide failed", err))
+			return
+		}
+		// The object is still in the bucket; a refresh puts it back in the feed.
+		go func() {
+			if _, _, err := s.refreshFeed(context.Background()); err != nil {
+				log.Printf("feed refresh after unhide: %v", err)
+			}
+		}()
+	case "approve":
+		if err := s.approvePending(r.Context(), key); err != nil {
+			handleError(w, err)
+			return
+		}
+	case "reject":
+		if err := s.rejectPending(r.Context(), key); err != nil {
+			handleError(w, err)
+			return
+		}
+	case "pin", "unpin":
+		if err := s.setPinned(r.Context(), key, action == "pin"); err != nil {
+			handleError(w, wrapError(ErrInternal, action+" failed", err))
+			return
+		}
+	default:
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	log.Printf("photo %s: key=%s", action, key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"key": key, "ok": action})
+}
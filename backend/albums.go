@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// albumPattern is what an album name may look like. Albums are stored as key prefixes
+// (kittenhood/photo.jpg), so names are kept to one URL- and path-safe segment.
+var albumPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// parseAlbum validates an album name from an upload or /feed request; empty means none.
+func parseAlbum(a string) (string, error) {
+	a = strings.ToLower(strings.TrimSpace(a))
+	if a == "" {
+		return "", nil
+	}
+	if !albumPattern.MatchString(a) || isDerivedKey(a+"/") || isQuarantineKey(a+"/") || isIncomingKey(a+"/") {
+		return "", newError(ErrValidation, "album must be 1-64 lowercase letters, digits, - or _")
+	}
+	return a, nil
+}
+
+// keyAlbum returns the album a key belongs to, or "" for keys at the top level.
+func keyAlbum(key string) string {
+	album, _, ok := strings.Cut(key, "/")
+	if !ok {
+		return ""
+	}
+	return album
+}
+
+// handleAlbums lists every album in the index with its item count.
+func (s *server) handleAlbums(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	counts := make(map[string]int)
+	s.feedByKeyMu.RLock()
+	for k := range s.feedByKey {
+		if a := keyAlbum(k); a != "" {
+			counts[a]++
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+
+	type album struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	albums := make([]album, 0, len(counts))
+	for name, n := range counts {
+		albums = append(albums, album{Name: name, Count: n})
+	}
+	sort.Slice(albums, func(i, j int) bool { return albums[i].Name < albums[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"albums": albums})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// animatedMetaName is set to "true" on animated GIFs, surfaced as the animated item field.
+const animatedMetaName = "animated"
+
+var errBadGIF = errors.New("malformed GIF")
+
+// gifFrames counts a GIF's frames by walking its blocks, without decoding any pixels, and
+// returns its logical screen size.
+func gifFrames(data []byte) (frames, width, height int, err error) {
+	if len(data) < 13 || (!bytes.HasPrefix(data, []byte("GIF87a")) && !bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return 0, 0, 0, errBadGIF
+	}
+	width, height = int(data[6])|int(data[7])<<8, int(data[8])|int(data[9])<<8
+	p := 13
+	if data[10]&0x80 != 0 {
+		p += 3 << (data[10]&7 + 1)
+	}
+	// skipBlocks steps over a chain of data sub-blocks, ending with the empty one.
+	skipBlocks := func() bool {
+		for p < len(data) {
+			n := int(data[p])
+			p += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for p < len(data) {
+		switch data[p] {
+		case 0x21: // extension: introducer, label, sub-blocks
+			p += 2
+			if !skipBlocks() {
+				return frames, width, height, errBadGIF
+			}
+		case 0x2c: // image descriptor, optional local color table, LZW code size, sub-blocks
+			if p+10 > len(data) {
+				return frames, width, height, errBadGIF
+			}
+			packed := data[p+9]
+			p += 10
+			if packed&0x80 != 0 {
+				p += 3 << (packed&7 + 1)
+			}
+			p++
+			if !skipBlocks() {
+				return frames, width, height, errBadGIF
+			}
+			frames++
+		case 0x3b: // trailer
+			return frames, width, height, nil
+		default:
+			return frames, width, height, errBadGIF
+		}
+	}
+	// Plenty of GIFs in the wild are missing the trailer; browsers play them anyway.
+	return frames, width, height, nil
+}
+
+// checkGIF applies MAX_GIF_FRAMES and MAX_GIF_PIXELS (every frame's pixels together) to a
+// GIF upload and reports whether it's animated. Other types pass as not animated. body is
+// rewound.
+func (s *server) checkGIF(body io.ReadSeeker, contentType string) (animated bool, err error) {
+	if contentType != "image/gif" {
+		return false, nil
+	}
+	data, err := io.ReadAll(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return false, newError(ErrValidation, "could not read image")
+	}
+	return s.checkGIFData(data)
+}
+
+func (s *server) checkGIFData(data []byte) (animated bool, err error) {
+	frames, width, height, err := gifFrames(data)
+	if err != nil {
+		return false, newError(ErrValidation, "could not read GIF")
+	}
+	if s.maxGIFFrames > 0 && frames > s.maxGIFFrames {
+		return false, newError(ErrUnprocessable, fmt.Sprintf("GIF has %d frames; the limit is %d", frames, s.maxGIFFrames))
+	}
+	if s.maxGIFPixels > 0 && int64(frames)*int64(width)*int64(height) > s.maxGIFPixels {
+		return false, newError(ErrUnprocessable, fmt.Sprintf("GIF is too large: %d frames of %dx%d", frames, width, height))
+	}
+	return frames > 1, nil
+}
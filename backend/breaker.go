@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// errR2Unavailable is returned for R2 calls made while the breaker is open.
+var errR2Unavailable = breakerOpenError{}
+
+type breakerOpenError struct{}
+
+func (breakerOpenError) Error() string { return "r2 circuit breaker open" }
+
+// RetryableError tells the SDK retryer not to retry a rejected call, so it fails fast.
+func (breakerOpenError) RetryableError() bool { return false }
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker trips after threshold consecutive failures and rejects calls for cooldown.
+// After that a single probe call is let through: success closes the breaker again, failure
+// reopens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may proceed. A threshold of 0 or less disables the breaker.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record reports the outcome of an allowed call.
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends an allowed call without counting it either way, e.g. when the caller gave up.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakerHTTPClient sits under the S3 client so every R2 operation goes through the breaker.
+// Transport errors and 5xx responses count as failures.
+type breakerHTTPClient struct {
+	next    aws.HTTPClient
+	breaker *circuitBreaker
+}
+
+func (c *breakerHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if !c.breaker.allow() {
+		return nil, errR2Unavailable
+	}
+	resp, err := c.next.Do(req)
+	if err != nil && errors.Is(req.Context().Err(), context.Canceled) {
+		c.breaker.release()
+		return resp, err
+	}
+	c.breaker.record(err == nil && resp.StatusCode < 500)
+	return resp, err
+}
+
+// r2Error categorizes a failed R2 call: a 503 with Retry-After when the breaker rejected it,
+// otherwise an upstream error with msg shown to the client.
+func (s *server) r2Error(msg string, err error) error {
+	if errors.Is(err, errR2Unavailable) {
+		return retryError(ErrUnavailable, "storage temporarily unavailable", s.r2Breaker.cooldown)
+	}
+	return wrapError(ErrUpstream, msg, err)
+}
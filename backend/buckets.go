@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// bucketSource is a read-only bucket merged into the feed alongside the primary one, e.g. an
+// archive of historical photos. Uploads always go to the primary bucket.
+type bucketSource struct {
+	name string
+	// urlBase plays the role of feedURLBase for this bucket's keys.
+	urlBase string
+}
+
+// sources returns every bucket the feed is built from, primary first.
+func (s *server) sources() []bucketSource {
+	return append([]bucketSource{{name: s.bucket, urlBase: s.feedURLBase}}, s.extraBuckets...)
+}
+
+// bucketURL returns the feed URL for key in bucket; "" means the primary bucket.
+func (s *server) bucketURL(bucket, key string) string {
+	for _, src := range s.extraBuckets {
+		if src.name == bucket {
+			return src.urlBase + "/" + key
+		}
+	}
+	return s.objectURL(key)
+}
+
+// keyBucket returns the bucket holding key, which may be a derived key (see isDerivedKey).
+// Must not be called with feedByKeyMu held.
+func (s *server) keyBucket(key string) string {
+	switch {
+	case isThumbKey(key):
+		key = strings.TrimPrefix(key, thumbPrefix)
+	case isRenditionKey(key):
+		if k, _, ok := parseRenditionKey(key); ok {
+			key = k
+		}
+	case isFormatKey(key):
+		if k, _, ok := parseFormatKey(key); ok {
+			key = k
+		}
+	}
+	s.feedByKeyMu.RLock()
+	b := s.feedStat[key].bucket
+	s.feedByKeyMu.RUnlock()
+	if b == "" {
+		return s.bucket
+	}
+	return b
+}
+
+// listFeed lists every source bucket and returns the feed candidates by key (see
+// feedListing), filled in from their photo records. A key present in more than one bucket is served from the first.
+func (s *server) listFeed(ctx context.Context) (map[string]objectStat, error) {
+	hidden, err := s.hiddenKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := s.pendingKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]objectStat)
+	for i, src := range s.sources() {
+		objects, err := listBucket(ctx, s.s3Client, src.name)
+		if err != nil {
+			return nil, err
+		}
+		objects, derived := splitDerived(objects)
+		for _, obj := range s.mediaObjects(ctx, src.name, objects) {
+			key := *obj.Key
+			// Keys reserved for direct uploads aren't live until they're confirmed.
+			if key == "" || hidden[key] || pending[key] || s.uploads.reserved(key) {
+				continue
+			}
+			if _, ok := stats[key]; ok {
+				log.Printf("feed listing: key=%s also in bucket %s, ignoring that copy", key, src.name)
+				continue
+			}
+			st := statFromObject(obj)
+			st.thumb = derived.thumbs[key]
+			st.renditions = derived.renditions[key]
+			st.formats = derived.formats[key]
+			if i > 0 {
+				st.bucket = src.name
+			}
+			stats[key] = st
+		}
+	}
+	s.applyPhotoRecords(stats)
+	return stats, nil
+}
+
+// deleteKeys deletes keys from whichever bucket holds each of them, returning results in
+// input order like deleteObjects.
+func (s *server) deleteKeys(ctx context.Context, keys []string) []deleteResult {
+	byBucket := make(map[string][]int)
+	for i, k := range keys {
+		b := s.keyBucket(k)
+		byBucket[b] = append(byBucket[b], i)
+	}
+	results := make([]deleteResult, len(keys))
+	for b, idx := range byBucket {
+		group := make([]string, len(idx))
+		for j, i := range idx {
+			group[j] = keys[i]
+		}
+		for j, res := range deleteObjects(ctx, s.s3Client, b, group) {
+			results[idx[j]] = res
+		}
+	}
+	return results
+}
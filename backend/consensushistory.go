@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// createConsensusSnapshotsTable creates the table of periodic vote tallies behind
+// /consensus/history, one row per hour.
+func createConsensusSnapshotsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS consensus_snapshots (
+			taken_at TIMESTAMPTZ PRIMARY KEY,
+			namu_is_tuxedo BIGINT NOT NULL,
+			namu_is_not_tuxedo BIGINT NOT NULL
+		);
+	`)
+	return err
+}
+
+// snapshotConsensus records the current tally in this hour's row. Later snapshots in the
+// same hour, from this instance or another, overwrite it, so the row ends up holding the
+// tally as of the end of the hour.
+func (s *server) snapshotConsensus(ctx context.Context) error {
+	c, err := s.consensusCounts(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO consensus_snapshots (taken_at, namu_is_tuxedo, namu_is_not_tuxedo)
+		VALUES (date_trunc('hour', NOW()), $1, $2)
+		ON CONFLICT (taken_at) DO UPDATE SET namu_is_tuxedo = $1, namu_is_not_tuxedo = $2
+	`, c.NamuIsTuxedo, c.NamuIsNotTuxedo)
+	return err
+}
+
+// runConsensusSnapshots snapshots the tally now and then every interval.
+func (s *server) runConsensusSnapshots(interval time.Duration) {
+	for {
+		if err := s.snapshotConsensus(context.Background()); err != nil {
+			log.Printf("consensus snapshot: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// consensusPoint is one entry in /consensus/history: the tally at the end of the period
+// starting At.
+type consensusPoint struct {
+	At time.Time `json:"at"`
+	consensus
+}
+
+// handleConsensusHistory serves GET /consensus/history?granularity=day|hour: the tally over
+// time, oldest first, one point per period that has a snapshot. limit (default 90) keeps
+// the latest periods.
+func (s *server) handleConsensusHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	granularity := q.Get("granularity")
+	switch granularity {
+	case "":
+		granularity = "day"
+	case "day", "hour":
+	default:
+		handleError(w, newError(ErrValidation, "granularity must be day or hour"))
+		return
+	}
+	limit := 90
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > 1000 {
+			handleError(w, newError(ErrValidation, "limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+	// The last snapshot in each period is its closing tally.
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT period, namu_is_tuxedo, namu_is_not_tuxedo FROM (
+			SELECT DISTINCT ON (period) period, namu_is_tuxedo, namu_is_not_tuxedo FROM (
+				SELECT date_trunc($1, taken_at) AS period, taken_at, namu_is_tuxedo, namu_is_not_tuxedo
+				FROM consensus_snapshots
+			) snapshots
+			ORDER BY period DESC, taken_at DESC
+			LIMIT $2
+		) latest
+		ORDER BY period
+	`, granularity, limit)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "consensus history failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	defer rows.Close()
+	points := []consensusPoint{}
+	for rows.Next() {
+		var p consensusPoint
+		if err := rows.Scan(&p.At, &p.NamuIsTuxedo, &p.NamuIsNotTuxedo); err != nil {
+			handleError(w, wrapError(ErrInternal, "consensus history failed", fmt.Errorf("scan: %w", err)))
+			return
+		}
+		p.consensus = p.consensus.withTotals()
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, wrapError(ErrInternal, "consensus history failed", fmt.Errorf("rows: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"granularity": granularity, "points": points})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/lib/pq"
+)
+
+// createUploadHashTable creates the index of uploads by SHA-256 of the file as received,
+// which lets /upload spot a photo that's already in the feed.
+func createUploadHashTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS upload_hashes (
+			sha256 TEXT PRIMARY KEY,
+			photo_key TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS upload_hashes_photo_key ON upload_hashes (photo_key);
+	`)
+	return err
+}
+
+// hashUpload returns the hex SHA-256 of body and rewinds it.
+func hashUpload(body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return "", errors.Join(err, serr)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// duplicateUpload returns the key of the photo already uploaded with this hash, if it's
+// still in the feed. A row left behind by a photo deleted outside this server is dropped.
+func (s *server) duplicateUpload(ctx context.Context, hash string) (key string, ok bool, err error) {
+	err = s.db.QueryRowContext(ctx, `SELECT photo_key FROM upload_hashes WHERE sha256 = $1`, hash).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	s.feedByKeyMu.RLock()
+	_, ok = s.feedByKey[key]
+	s.feedByKeyMu.RUnlock()
+	if !ok {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM upload_hashes WHERE sha256 = $1`, hash)
+	}
+	return key, ok, err
+}
+
+// recordUploadHash indexes a stored upload by hash, replacing the hash of whatever the key
+// held before. Of two identical uploads racing, the first recorded wins.
+func (s *server) recordUploadHash(ctx context.Context, hash, key string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM upload_hashes WHERE photo_key = $1`, key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO upload_hashes (sha256, photo_key) VALUES ($1, $2) ON CONFLICT (sha256) DO NOTHING`,
+		hash, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetUploadHashes drops the hashes of deleted photos, so they can be uploaded again.
+func (s *server) forgetUploadHashes(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `DELETE FROM upload_hashes WHERE photo_key = ANY($1)`, pq.Array(keys))
+	return err
+}
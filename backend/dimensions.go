@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// IMAGE_OVERSIZE modes: what happens to an image larger than MAX_IMAGE_DIMENSION.
+const (
+	oversizeDownscale = "downscale" // scale it down to fit (JPEG and PNG only)
+	oversizeReject    = "reject"
+)
+
+// parseOversizeMode validates an IMAGE_OVERSIZE value; empty means downscale.
+func parseOversizeMode(v string) (string, error) {
+	switch v {
+	case "":
+		return oversizeDownscale, nil
+	case oversizeDownscale, oversizeReject:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want downscale or reject)", v)
+}
+
+// limitDimensions applies MAX_IMAGE_DIMENSION to an upload before it's stored, returning the
+// body to store and its size. Images within the limit, and other media, are returned as is
+// with body rewound; see fitDimensions for the rest.
+func (s *server) limitDimensions(body io.ReadSeeker, size int64, contentType string) (io.ReadSeeker, int64, error) {
+	if s.maxImageDim <= 0 || mediaKind(contentType) != "image" {
+		return body, size, nil
+	}
+	if w, h := imageDimensions(body); max(w, h) <= s.maxImageDim {
+		return body, size, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, newError(ErrValidation, "could not read image")
+	}
+	out, err := s.fitDimensions(data, contentType)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(out), int64(len(out)), nil
+}
+
+// fitDimensions returns data scaled down so neither side exceeds MAX_IMAGE_DIMENSION, or nil
+// when it already fits or can't be decoded. An oversized image is rejected instead in
+// reject mode, or when it's a format that can't be re-encoded. Scaling re-encodes without
+// EXIF, so anything wanted from it must be read first.
+func (s *server) fitDimensions(data []byte, contentType string) ([]byte, error) {
+	if s.maxImageDim <= 0 {
+		return nil, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || max(cfg.Width, cfg.Height) <= s.maxImageDim {
+		return nil, nil
+	}
+	if s.oversizeMode == oversizeReject || (contentType != "image/jpeg" && contentType != "image/png") {
+		return nil, newError(ErrUnprocessable, fmt.Sprintf("image is %dx%d; neither side may exceed %dpx", cfg.Width, cfg.Height, s.maxImageDim))
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, wrapError(ErrUnprocessable, "could not resize image", err)
+	}
+	var buf bytes.Buffer
+	if contentType == "image/png" {
+		err = png.Encode(&buf, scaleDown(src, s.maxImageDim))
+	} else {
+		err = jpeg.Encode(&buf, scaleDown(src, s.maxImageDim), &jpeg.Options{Quality: orientJPEGQuality})
+	}
+	if err != nil {
+		return nil, wrapError(ErrInternal, "could not resize image", err)
+	}
+	return buf.Bytes(), nil
+}
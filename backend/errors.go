@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error categories. Handlers return errors wrapping one of these and handleError picks the
+// status from it; anything uncategorized is a 500.
+var (
+	ErrValidation       = errors.New("validation")
+	ErrUnprocessable    = errors.New("unprocessable")
+	ErrNotFound         = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrForbidden        = errors.New("forbidden")
+	ErrConflict         = errors.New("conflict")
+	ErrTooLarge         = errors.New("too large")
+	ErrUnsupportedType  = errors.New("unsupported media type")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrUnavailable      = errors.New("unavailable")
+	ErrUpstream         = errors.New("upstream")
+	ErrInternal         = errors.New("internal")
+)
+
+var errorStatus = []struct {
+	kind   error
+	status int
+}{
+	{ErrValidation, http.StatusBadRequest},
+	{ErrUnprocessable, http.StatusUnprocessableEntity},
+	{ErrNotFound, http.StatusNotFound},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed},
+	{ErrUnauthorized, http.StatusUnauthorized},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrConflict, http.StatusConflict},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge},
+	{ErrUnsupportedType, http.StatusUnsupportedMediaType},
+	{ErrRateLimited, http.StatusTooManyRequests},
+	{ErrUnavailable, http.StatusServiceUnavailable},
+	{ErrUpstream, http.StatusBadGateway},
+	{ErrInternal, http.StatusInternalServerError},
+}
+
+// apiError carries the message shown to the client alongside the category and, for server
+// errors, the underlying cause that only goes to the log.
+type apiError struct {
+	kind       error
+	msg        string
+	cause      error
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	if e.cause != nil {
+		return e.msg + ": " + e.cause.Error()
+	}
+	return e.msg
+}
+
+func (e *apiError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.cause}
+}
+
+func newError(kind error, msg string) error {
+	return &apiError{kind: kind, msg: msg}
+}
+
+// wrapError attaches cause to a client-facing message; the cause is logged, not returned.
+func wrapError(kind error, msg string, cause error) error {
+	return &apiError{kind: kind, msg: msg, cause: cause}
+}
+
+// retryError is a kind/msg error that also sets Retry-After.
+func retryError(kind error, msg string, after time.Duration) error {
+	return &apiError{kind: kind, msg: msg, retryAfter: after}
+}
+
+var errMethodNotAllowed = newError(ErrMethodNotAllowed, "method not allowed")
+
+// handleError writes err as a JSON {"error": ...} body with the status for its category.
+// Server errors are logged with their cause and never echo it to the client.
+func handleError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	for _, es := range errorStatus {
+		if errors.Is(err, es.kind) {
+			status = es.status
+			break
+		}
+	}
+	msg := "internal error"
+	var ae *apiError
+	if errors.As(err, &ae) {
+		msg = ae.msg
+		if ae.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ae.retryAfter.Seconds()))))
+		}
+	}
+	if status >= 500 {
+		log.Printf("%s: %v", msg, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
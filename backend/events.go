@@ -0,0 +1,84 @@
+package main
+
+import "sync"
+
+// hubEventBuffer is how many events a subscriber may fall behind before it starts missing
+// them.
+const hubEventBuffer = 16
+
+// Hub event types.
+const (
+	eventPhotoAdded       = "photo_added"
+	eventConsensusChanged = "consensus_changed"
+)
+
+// hubEvent is something live clients are told about, e.g. a photo_added with its feed item.
+type hubEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// eventHub fans events out to every subscriber. Publishing never blocks: a subscriber whose
+// buffer is full misses the event rather than stalling the publisher. Events are local to
+// this instance.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan hubEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan hubEvent]struct{})}
+}
+
+// subscribe returns a channel of future events and a func that unsubscribes and closes it.
+func (h *eventHub) subscribe() (<-chan hubEvent, func()) {
+	ch := make(chan hubEvent, hubEventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// hasSubscribers lets publishers skip building events nobody will receive.
+func (h *eventHub) hasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// publish sends ev to every current subscriber.
+func (h *eventHub) publish(ev hubEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishPhotoAdded announces key with the same item shape /feed returns, to live
+// subscribers and the outbound webhooks.
+func (s *server) publishPhotoAdded(key string) {
+	live := s.events.hasSubscribers()
+	if !live && s.webhooks == nil {
+		return
+	}
+	items := s.feedResponse([]string{s.objectURL(key)}, nil)["items"].([]map[string]interface{})
+	ev := hubEvent{Type: eventPhotoAdded, Data: items[0]}
+	if live {
+		s.events.publish(ev)
+	}
+	if s.webhooks != nil {
+		s.webhooks.send(ev)
+	}
+}
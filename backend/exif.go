@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// EXIF tags this server reads.
+const (
+	exifTagExifIFD          = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+	exifTagGPSIFD           = 0x8825
+	exifTagOrientation      = 0x0112
+)
+
+// exifTimeLayout is how EXIF writes timestamps. They carry no zone and are taken as UTC.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// exifHeader starts an APP1 segment holding EXIF rather than XMP.
+var exifHeader = []byte("Exif\x00\x00")
+
+var errNoExif = errors.New("no exif data")
+
+// jpegExif returns the TIFF-formatted EXIF block from a JPEG's APP1 segment.
+func jpegExif(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errNoExif
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return nil, errNoExif
+		}
+		// Start of scan: image data follows and there are no more metadata segments.
+		if marker[1] == 0xDA {
+			return nil, errNoExif
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if n < 0 {
+			return nil, errNoExif
+		}
+		if marker[1] != 0xE1 {
+			if _, err := br.Discard(n); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return nil, errNoExif
+		}
+		if tiff, ok := bytes.CutPrefix(seg, exifHeader); ok {
+			return tiff, nil
+		}
+	}
+}
+
+// exifIFD reads the IFD at off in tiff and returns each entry's raw 4-byte value field by
+// tag, which holds either the value itself or an offset to it.
+func exifIFD(tiff []byte, order binary.ByteOrder, off uint32) map[uint16][]byte {
+	if int(off)+2 > len(tiff) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[off:]))
+	entries := make(map[uint16][]byte, count)
+	for i := 0; i < count; i++ {
+		e := int(off) + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		entries[order.Uint16(tiff[e:])] = tiff[e+8 : e+12]
+	}
+	return entries
+}
+
+// exifByteOrder reads the TIFF header, returning the byte order and IFD0's offset.
+func exifByteOrder(tiff []byte) (binary.ByteOrder, uint32, bool) {
+	if len(tiff) < 8 {
+		return nil, 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return order, order.Uint32(tiff[4:]), true
+}
+
+// exifTakenAt returns a JPEG's DateTimeOriginal, the time the photo was taken, and rewinds
+// body. ok is false when the image has no usable capture time.
+func exifTakenAt(body io.ReadSeeker) (taken time.Time, ok bool) {
+	defer body.Seek(0, io.SeekStart)
+	tiff, err := jpegExif(body)
+	if err != nil {
+		return time.Time{}, false
+	}
+	order, ifd0, valid := exifByteOrder(tiff)
+	if !valid {
+		return time.Time{}, false
+	}
+	ptr, found := exifIFD(tiff, order, ifd0)[exifTagExifIFD]
+	if !found {
+		return time.Time{}, false
+	}
+	val, found := exifIFD(tiff, order, order.Uint32(ptr))[exifTagDateTimeOriginal]
+	if !found {
+		return time.Time{}, false
+	}
+	// The 20-byte ASCII value doesn't fit in the entry, so val is its offset.
+	off := int(order.Uint32(val))
+	if off+19 > len(tiff) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(exifTimeLayout, strings.TrimRight(string(tiff[off:off+19]), "\x00 "))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// exifScanBytes is how much of each object the backfill fetches; EXIF sits in an APP1
+// segment near the start of the file, capped at 64 KB.
+const exifScanBytes = 128 << 10
+
+// backfillTakenAt reads the capture time of every JPEG in the index that doesn't have one
+// yet. Times found for primary-bucket objects are also written back as object metadata
+// (a copy onto itself), so later listings and metadata syncs keep them.
+func (s *server) backfillTakenAt(ctx context.Context) (updated int) {
+	s.feedByKeyMu.RLock()
+	var keys []string
+	for k, st := range s.feedStat {
+		if st.takenAt.IsZero() && s.contentType(k) == "image/jpeg" {
+			keys = append(keys, k)
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+
+	for _, k := range keys {
+		bucket := s.keyBucket(k)
+		obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(k),
+			Range:  aws.String(fmt.Sprintf("bytes=0-%d", exifScanBytes-1)),
+		})
+		if err != nil {
+			log.Printf("exif backfill get: key=%s err=%v", k, err)
+			continue
+		}
+		head, err := io.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			log.Printf("exif backfill read: key=%s err=%v", k, err)
+			continue
+		}
+		taken, ok := exifTakenAt(bytes.NewReader(head))
+		if !ok {
+			continue
+		}
+		if bucket == s.bucket {
+			if err := s.setObjectMetadata(ctx, k, map[string]string{takenAtMetaName: taken.Format(time.RFC3339)}); err != nil {
+				log.Printf("exif backfill write: key=%s err=%v", k, err)
+			}
+		}
+		s.feedByKeyMu.Lock()
+		st, ok := s.feedStat[k]
+		if ok {
+			st.takenAt = taken
+			s.feedStat[k] = st
+			s.invalidateFeedCache()
+		}
+		meta := s.feedMeta[k]
+		s.feedByKeyMu.Unlock()
+		if ok {
+			s.shareFeedObject(ctx, k, newSnapshotObject(st, meta))
+			updated++
+		}
+	}
+	return updated
+}
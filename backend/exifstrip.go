@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// EXIF_STRIP modes: what identifying metadata is removed from JPEG uploads before they're
+// stored, since R2 serves the file exactly as uploaded.
+const (
+	exifStripNone = "none"
+	exifStripGPS  = "gps" // the location only; the default
+	exifStripAll  = "all" // every EXIF field except the orientation
+)
+
+var (
+	xmpHeaders   = [][]byte{[]byte("http://ns.adobe.com/xap/1.0/\x00"), []byte("http://ns.adobe.com/xmp/extension/\x00")}
+	exifTypeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+)
+
+func parseExifStrip(v string) (string, error) {
+	switch v {
+	case "":
+		return exifStripGPS, nil
+	case exifStripNone, exifStripGPS, exifStripAll:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want none, gps or all)", v)
+}
+
+// stripUpload applies the EXIF_STRIP mode to a JPEG upload, returning the body to store and
+// its size. Other formats are stored as is; phones send JPEG, or HEIC which is converted
+// to JPEG (EXIF included) first.
+func (s *server) stripUpload(body io.ReadSeeker, size int64, contentType string) (io.ReadSeeker, int64, error) {
+	if contentType != "image/jpeg" || s.exifStrip == exifStripNone {
+		return body, size, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, _ := stripJPEGMetadata(data, s.exifStrip)
+	return bytes.NewReader(out), int64(len(out)), nil
+}
+
+// stripJPEGMetadata removes the GPS fields (mode gps) or the whole EXIF block (mode all)
+// from a JPEG. XMP packets, which can repeat any EXIF field, are dropped in both modes. In
+// all mode a non-default orientation is kept in a minimal EXIF block so the photo still
+// displays upright. changed reports whether anything was removed; data that isn't a
+// well-formed JPEG is returned untouched.
+func stripJPEGMetadata(data []byte, mode string) (out []byte, changed bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data, false
+	}
+	out = make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	for i := 2; ; {
+		if i+4 > len(data) || data[i] != 0xFF {
+			return data, false
+		}
+		// Start of scan: the rest is image data.
+		if data[i+1] == 0xDA {
+			out = append(out, data[i:]...)
+			return out, changed
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end < i+4 || end > len(data) {
+			return data, false
+		}
+		seg, payload := data[i:end], data[i+4:end]
+		i = end
+		if seg[1] != 0xE1 {
+			out = append(out, seg...)
+			continue
+		}
+		if isXMP(payload) {
+			changed = true
+			continue
+		}
+		tiff, ok := bytes.CutPrefix(payload, exifHeader)
+		if !ok {
+			out = append(out, seg...)
+			continue
+		}
+		switch mode {
+		case exifStripAll:
+			changed = true
+			if o := exifOrientation(tiff); o > 1 {
+				out = append(out, orientationSegment(o)...)
+			}
+		case exifStripGPS:
+			if clean, found := zeroGPS(tiff); found {
+				changed = true
+				out = append(out, seg[:4+len(exifHeader)]...)
+				out = append(out, clean...)
+			} else {
+				out = append(out, seg...)
+			}
+		default:
+			out = append(out, seg...)
+		}
+	}
+}
+
+func isXMP(payload []byte) bool {
+	for _, h := range xmpHeaders {
+		if bytes.HasPrefix(payload, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// zeroGPS returns a copy of tiff with the GPS IFD emptied: its entries and the values they
+// point to are zeroed and its entry count set to 0, so no offsets elsewhere move. found is
+// false when there's no GPS IFD.
+func zeroGPS(tiff []byte) (clean []byte, found bool) {
+	order, ifd0, ok := exifByteOrder(tiff)
+	if !ok {
+		return nil, false
+	}
+	ptr, ok := exifIFD(tiff, order, ifd0)[exifTagGPSIFD]
+	if !ok {
+		return nil, false
+	}
+	off := int(order.Uint32(ptr))
+	if off+2 > len(tiff) {
+		return nil, false
+	}
+	clean = append([]byte(nil), tiff...)
+	count := int(order.Uint16(clean[off:]))
+	for n := 0; n < count; n++ {
+		e := off + 2 + n*12
+		if e+12 > len(clean) {
+			break
+		}
+		size := exifTypeSize[order.Uint16(clean[e+2:])] * int(order.Uint32(clean[e+4:]))
+		if size > 4 {
+			if v := int(order.Uint32(clean[e+8:])); v >= 0 && v+size <= len(clean) {
+				clear(clean[v : v+size])
+			}
+		}
+		clear(clean[e : e+12])
+	}
+	order.PutUint16(clean[off:], 0)
+	return clean, true
+}
+
+// exifOrientation returns IFD0's Orientation (1-8), or 0 if it has none.
+func exifOrientation(tiff []byte) int {
+	order, ifd0, ok := exifByteOrder(tiff)
+	if !ok {
+		return 0
+	}
+	val, ok := exifIFD(tiff, order, ifd0)[exifTagOrientation]
+	if !ok {
+		return 0
+	}
+	return int(order.Uint16(val))
+}
+
+// orientationSegment is an APP1 segment whose EXIF holds nothing but the orientation.
+func orientationSegment(o int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian header, IFD0 at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0, // Orientation, SHORT, count 1
+		0, 0, 0, 0, // no next IFD
+	}
+	seg := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len(exifHeader)+len(tiff)))
+	seg = append(seg, exifHeader...)
+	return append(seg, tiff...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/lib/pq"
+)
+
+// serveCounter counts how often each photo has been served across all clients, so random
+// selection can favor the least-served ones (FAIR_ROTATION).
+type serveCounter struct {
+	db *sql.DB
+}
+
+// newServeCounter creates the photo_serves table if needed.
+func newServeCounter(ctx context.Context, db *sql.DB) (*serveCounter, error) {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS photo_serves (
+			photo_key TEXT PRIMARY KEY,
+			serve_count BIGINT NOT NULL DEFAULT 0,
+			last_served_at TIMESTAMPTZ DEFAULT NOW()
+		);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return &serveCounter{db: db}, nil
+}
+
+// counts returns the serve count of each key that has been served; missing keys are unserved.
+func (c *serveCounter) counts(ctx context.Context, keys []string) (map[string]int64, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT photo_key, serve_count FROM photo_serves WHERE photo_key = ANY($1)`, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]int64)
+	for rows.Next() {
+		var k string
+		var n int64
+		if err := rows.Scan(&k, &n); err != nil {
+			return nil, err
+		}
+		out[k] = n
+	}
+	return out, rows.Err()
+}
+
+func (c *serveCounter) record(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO photo_serves (photo_key, serve_count)
+		SELECT unnest($1::text[]), 1
+		ON CONFLICT (photo_key) DO UPDATE SET serve_count = photo_serves.serve_count + 1, last_served_at = NOW()
+	`, pq.Array(keys))
+	return err
+}
+
+// forget drops the counters of deleted photos.
+func (c *serveCounter) forget(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.db.ExecContext(ctx, `DELETE FROM photo_serves WHERE photo_key = ANY($1)`, pq.Array(keys))
+	return err
+}
+
+// weightedSample draws count of urls without replacement, each weighted 1/(1+serves) so
+// rarely served photos come up more often (Efraimidis-Spirakis: keep the count largest
+// u^(1/w)). serves is keyed by URL.
+func weightedSample(rng *rand.Rand, urls []string, serves map[string]int64, count int) []string {
+	type scored struct {
+		url   string
+		score float64
+	}
+	all := make([]scored, len(urls))
+	for i, u := range urls {
+		w := 1 / float64(1+serves[u])
+		all[i] = scored{u, math.Pow(rng.Float64(), 1/w)}
+	}
+	// Partial selection sort; count is a feed batch, so this stays cheap.
+	out := make([]string, count)
+	for i := 0; i < count; i++ {
+		best := i
+		for j := i + 1; j < len(all); j++ {
+			if all[j].score > all[best].score {
+				best = j
+			}
+		}
+		all[i], all[best] = all[best], all[i]
+		out[i] = all[i].url
+	}
+	return out
+}
+
+// fairWeights looks up serve counts for available, keyed by URL, when fair rotation is on.
+// Lookup failures fall back to uniform selection rather than failing the request.
+func (s *server) fairWeights(ctx context.Context, available []string) map[string]int64 {
+	if s.serves == nil {
+		return nil
+	}
+	byKey, err := s.serves.counts(ctx, s.urlKeys(available))
+	if err != nil {
+		log.Printf("serve counts: %v", err)
+		return nil
+	}
+	out := make(map[string]int64, len(byKey))
+	for _, u := range available {
+		out[u] = byKey[s.urlKey(u)]
+	}
+	return out
+}
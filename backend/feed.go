@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	fields, err := parseFeedFields(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	order, err := parseFeedOrder(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	seed, err := parseFeedSeed(r.URL.Query(), order)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	clientKey, limit, ok := s.parseFeedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Has("cursor") {
+		s.handleFeedPage(w, r, limit, fields, order)
+		return
+	}
+
+	// Pinned photos lead every batch and sit outside the seen rotation.
+	pinned, pool := s.splitPinned(s.feedPool(r.URL.Query()))
+	pinnedTotal := len(pinned)
+	pinned = pinned[:min(len(pinned), limit)]
+	ackMode := r.URL.Query().Get("ack") == "1"
+	batch, err := s.pickFeed(r.Context(), clientKey, r.URL.Query().Get("device"), pool, limit-len(pinned), ackMode, order, seed)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "feed failed", err))
+		return
+	}
+	batch.urls = append(pinned, batch.urls...)
+	batch.total += pinnedTotal
+	if s.views != nil {
+		s.views.add(s.urlKeys(batch.urls))
+	}
+
+	resp := s.feedResponse(batch.urls, fields)
+	size, _ := parseRenditionSize(r.URL.Query())
+	s.applyRenditionSize(resp, batch.urls, size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch.response(resp))
+}
+
+// feedBatch is one /feed selection plus the pool counts reported with it.
+type feedBatch struct {
+	urls            []string
+	total           int  // size of the (filtered) pool
+	unseenRemaining int  // pool entries still unseen once this batch is
+	wrapped         bool // every entry had been seen, so the rotation started over
+}
+
+// response adds the batch counts to a feedResponse body.
+func (b feedBatch) response(resp map[string]interface{}) map[string]interface{} {
+	resp["total"] = b.total
+	resp["unseen_remaining"] = b.unseenRemaining
+	resp["wrapped"] = b.wrapped
+	return resp
+}
+
+// handleFeedPeek returns a batch like /feed would, without marking anything seen or
+// pending. It works on a snapshot of the client's seen-set, so a concurrent /feed call may
+// still serve different images than the ones peeked.
+func (s *server) handleFeedPeek(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	fields, err := parseFeedFields(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	order, err := parseFeedOrder(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	seed, err := parseFeedSeed(r.URL.Query(), order)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	clientKey, limit, ok := s.parseFeedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	pool := s.feedPool(r.URL.Query())
+	seen, err := s.requestSeen.seen(r.Context(), seenKey(clientKey, r.URL.Query().Get("device")))
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "feed failed", err))
+		return
+	}
+	available := s.unseenURLs(pool, seen)
+	wrapped := len(available) == 0 && len(pool) > 0
+	if wrapped {
+		available = pool
+	}
+	choice := s.feedChoice(r.Context(), order, seed, clientKey, pool, available)
+	s.requestSeenMu.Lock()
+	out := s.chooseFeedURLs(available, min(limit, len(available)), choice)
+	s.requestSeenMu.Unlock()
+
+	batch := feedBatch{urls: out, total: len(pool), unseenRemaining: len(available) - len(out), wrapped: wrapped}
+	resp := s.feedResponse(out, fields)
+	size, _ := parseRenditionSize(r.URL.Query())
+	s.applyRenditionSize(resp, out, size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch.response(resp))
+}
+
+// pageCursor is the position after the last item of a page, encoded as base64 JSON.
+type pageCursor struct {
+	Key      string `json:"k"`
+	Modified int64  `json:"t,omitempty"` // unix nanos; only used by newest/oldest
+}
+
+// handleFeedPage serves cursor mode (/feed?cursor=): a stable page of the pool, with no seen
+// bookkeeping, ordered by key or by order=newest/oldest. An empty cursor starts at the
+// beginning and next_cursor is omitted on the last page.
+func (s *server) handleFeedPage(w http.ResponseWriter, r *http.Request, limit int, fields []string, order string) {
+	if r.URL.Query().Get("order") == orderRandom {
+		handleError(w, newError(ErrValidation, "order=random can't be paged with a cursor"))
+		return
+	}
+	var after *orderedURL
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var pc pageCursor
+		b, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			err = json.Unmarshal(b, &pc)
+		}
+		if err != nil {
+			handleError(w, newError(ErrValidation, "invalid cursor"))
+			return
+		}
+		after = &orderedURL{key: pc.Key}
+		if pc.Modified != 0 {
+			after.modified = time.Unix(0, pc.Modified)
+		}
+	}
+	pool := s.sortFeedURLs(s.feedPool(r.URL.Query()), order)
+	start := 0
+	if after != nil {
+		start = sort.Search(len(pool), func(i int) bool { return orderedLess(order, *after, pool[i]) })
+	}
+	end := min(start+limit, len(pool))
+	page := make([]string, 0, end-start)
+	for _, e := range pool[start:end] {
+		page = append(page, e.url)
+	}
+
+	if s.views != nil {
+		s.views.add(s.urlKeys(page))
+	}
+	resp := s.feedResponse(page, fields)
+	size, _ := parseRenditionSize(r.URL.Query())
+	s.applyRenditionSize(resp, page, size)
+	resp["total"] = len(pool)
+	if end < len(pool) {
+		last := pool[end-1]
+		pc := pageCursor{Key: last.key}
+		if !last.modified.IsZero() {
+			pc.Modified = last.modified.UnixNano()
+		}
+		b, _ := json.Marshal(pc)
+		resp["next_cursor"] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseFeedRequest reads the key and limit params shared by the feed endpoints and applies
+// the per-key rate limit, writing an error response when the request can't proceed.
+func (s *server) parseFeedRequest(w http.ResponseWriter, r *http.Request) (clientKey string, limit int, ok bool) {
+	limit = currentTunables().FeedDefaultLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	clientKey = r.URL.Query().Get("key")
+	if clientKey == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return "", 0, false
+	}
+	if c := r.URL.Query().Get("cat"); c != "" {
+		if _, err := parseCat(c); err != nil {
+			handleError(w, err)
+			return "", 0, false
+		}
+	}
+	if _, err := parseAlbum(r.URL.Query().Get("album")); err != nil {
+		handleError(w, err)
+		return "", 0, false
+	}
+	if _, _, err := parseDateRange(r.URL.Query()); err != nil {
+		handleError(w, err)
+		return "", 0, false
+	}
+	if _, err := parseRenditionSize(r.URL.Query()); err != nil {
+		handleError(w, err)
+		return "", 0, false
+	}
+	if allowed, retry := s.feedLimiter.allow(clientKey); !allowed {
+		handleError(w, retryError(ErrRateLimited, "rate limit exceeded", retry))
+		return "", 0, false
+	}
+	return clientKey, limit, true
+}
+
+// feedPool returns every feed URL matching the request's meta.*, cat, album and date
+// filters.
+func (s *server) feedPool(q url.Values) []string {
+	filters := metaFilters(q)
+	cat := strings.ToLower(q.Get("cat"))
+	album, _ := parseAlbum(q.Get("album"))
+	from, to, _ := parseDateRange(q)
+	list := s.feedList()
+	pool := make([]string, 0, len(list))
+	for _, e := range list {
+		if filters != nil && !matchesMeta(e.meta, filters) {
+			continue
+		}
+		if cat != "" && !matchesCat(e.meta, cat) {
+			continue
+		}
+		if album != "" && keyAlbum(e.key) != album {
+			continue
+		}
+		if (!from.IsZero() && e.taken.Before(from)) || (!to.IsZero() && !e.taken.Before(to)) {
+			continue
+		}
+		pool = append(pool, e.url)
+	}
+	return pool
+}
+
+// parseDateRange reads the from and to params as dates (2024-01-01) or RFC 3339 times. They
+// filter on capture time where known, else upload time. The range is [from, to), except
+// that a date-only to covers that whole day. Zero times mean unbounded.
+func parseDateRange(q url.Values) (from, to time.Time, err error) {
+	parse := func(name string) (time.Time, bool, error) {
+		v := q.Get(name)
+		if v == "" {
+			return time.Time{}, false, nil
+		}
+		if t, err := time.Parse(time.DateOnly, v); err == nil {
+			return t, true, nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, false, newError(ErrValidation, name+" must be a date (2024-01-31) or RFC 3339 time")
+		}
+		return t, false, nil
+	}
+	from, _, err = parse("from")
+	if err != nil {
+		return
+	}
+	to, dateOnly, err := parse("to")
+	if err != nil {
+		return
+	}
+	if dateOnly {
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		err = newError(ErrValidation, "from must be before to")
+	}
+	return
+}
+
+// unseenURLs returns the URLs in pool whose keys aren't in seen.
+func (s *server) unseenURLs(pool []string, seen map[string]struct{}) []string {
+	available := make([]string, 0, len(pool))
+	for _, u := range pool {
+		if _, sent := seen[s.urlKey(u)]; !sent {
+			available = append(available, u)
+		}
+	}
+	return available
+}
+
+// pickFeed selects up to limit URLs from pool that the client hasn't seen yet, at random, in
+// a seeded sequence or in order (see chooseFeedURLs), starting the rotation over once every
+// URL in pool has been seen. Picks are marked seen, or in ack mode held as pending; an
+// outstanding pending batch is returned again unchanged.
+//
+// The seen-set is read before and written after the selection, so two concurrent requests
+// for the same client may overlap; that's accepted to keep store round trips outside the lock.
+func (s *server) pickFeed(ctx context.Context, clientKey, device string, pool []string, limit int, ackMode bool, order, seed string) (feedBatch, error) {
+	n := len(pool)
+	if n == 0 {
+		return feedBatch{urls: []string{}}, nil
+	}
+	if limit > n {
+		limit = n
+	}
+
+	sk := seenKey(clientKey, device)
+	s.requestSeenMu.Lock()
+	s.touchClient(sk)
+	pending := append([]string(nil), s.requestPending[sk]...)
+	s.requestSeenMu.Unlock()
+
+	seen, err := s.requestSeen.seen(ctx, sk)
+	if err != nil {
+		return feedBatch{}, err
+	}
+	available := s.unseenURLs(pool, seen)
+	if ackMode && len(pending) > 0 {
+		// Pending URLs aren't marked seen yet but are already spoken for.
+		return feedBatch{urls: pending, total: n, unseenRemaining: max(len(available)-len(pending), 0)}, nil
+	}
+	wrapped := len(available) == 0
+	if wrapped {
+		// Only forget the keys in this (possibly filtered) pool so a filtered
+		// rotation doesn't reset the client's unfiltered one.
+		if err := s.requestSeen.unmarkSeen(ctx, sk, s.urlKeys(pool)); err != nil {
+			return feedBatch{}, err
+		}
+		available = append(available[:0], pool...)
+	}
+
+	log.Printf("new request: key=%s limit=%d available=%d seen=%d", clientKey, limit, len(available), len(seen))
+
+	choice := s.feedChoice(ctx, order, seed, clientKey, pool, available)
+	s.requestSeenMu.Lock()
+	out := s.chooseFeedURLs(available, min(limit, len(available)), choice)
+	if ackMode {
+		s.requestPending[sk] = append([]string(nil), out...)
+	}
+	s.requestSeenMu.Unlock()
+	if !ackMode {
+		if err := s.requestSeen.markSeen(ctx, sk, s.urlKeys(out)); err != nil {
+			return feedBatch{}, err
+		}
+	}
+	if s.serves != nil {
+		if err := s.serves.record(ctx, s.urlKeys(out)); err != nil {
+			log.Printf("serve counts record: %v", err)
+		}
+	}
+	return feedBatch{urls: out, total: n, unseenRemaining: len(available) - len(out), wrapped: wrapped}, nil
+}
+
+// feedChoice builds the selection options for a batch. Fair rotation only applies to
+// unseeded random order, since a seed promises a fixed sequence.
+func (s *server) feedChoice(ctx context.Context, order, seed, clientKey string, pool, available []string) feedChoice {
+	c := feedChoice{order: order}
+	switch {
+	case seed != "":
+		c.seeded = seededPermutation(pool, clientKey, seed)
+	case order == orderRandom:
+		c.serves = s.fairWeights(ctx, available)
+	}
+	return c
+}
+
+// urlKeys maps feed URLs to their bucket keys.
+func (s *server) urlKeys(urls []string) []string {
+	keys := make([]string, len(urls))
+	for i, u := range urls {
+		keys[i] = s.urlKey(u)
+	}
+	return keys
+}
+
+func (s *server) handleFeedAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	clientKey := r.URL.Query().Get("key")
+	u := stripToken(r.URL.Query().Get("url"))
+	if clientKey == "" || u == "" {
+		handleError(w, newError(ErrValidation, "key and url required"))
+		return
+	}
+	sk := seenKey(clientKey, r.URL.Query().Get("device"))
+	s.requestSeenMu.Lock()
+	pending := s.requestPending[sk]
+	found := false
+	for i, p := range pending {
+		if p == u {
+			pending = append(pending[:i], pending[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		if len(pending) == 0 {
+			delete(s.requestPending, sk)
+		} else {
+			s.requestPending[sk] = pending
+		}
+		s.touchClient(sk)
+	}
+	s.requestSeenMu.Unlock()
+	if !found {
+		handleError(w, newError(ErrNotFound, "url not pending for key"))
+		return
+	}
+	if err := s.requestSeen.markSeen(r.Context(), sk, []string{s.urlKey(u)}); err != nil {
+		handleError(w, wrapError(ErrInternal, "ack failed", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ok": "acked"})
+}
+
+// handleFeedReset clears a client's seen-set (per device when device is given) and any
+// unacknowledged ack-mode batch, so its rotation starts over. It reports how many seen
+// photos were cleared.
+func (s *server) handleFeedReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	clientKey := r.URL.Query().Get("key")
+	if clientKey == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return
+	}
+	sk := seenKey(clientKey, r.URL.Query().Get("device"))
+	s.requestSeenMu.Lock()
+	delete(s.requestPending, sk)
+	s.requestSeenMu.Unlock()
+	n, err := s.requestSeen.reset(r.Context(), sk)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "reset failed", err))
+		return
+	}
+	log.Printf("feed reset: key=%s cleared=%d", clientKey, n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"cleared": n})
+}
+
+// touchClient moves sk to the front of the LRU list, admitting it if new. When that pushes
+// the number of tracked clients past maxTrackedClients, the least recently used client's
+// seen-set and pending batch are dropped. Must be called with requestSeenMu held.
+func (s *server) touchClient(sk string) {
+	if el, ok := s.clientLRUIndex[sk]; ok {
+		el.Value.(*trackedClient).lastUsed = time.Now()
+		s.clientLRU.MoveToFront(el)
+		return
+	}
+	s.clientLRUIndex[sk] = s.clientLRU.PushFront(&trackedClient{key: sk, lastUsed: time.Now()})
+	if s.maxTrackedClients <= 0 {
+		return
+	}
+	for s.clientLRU.Len() > s.maxTrackedClients {
+		s.evictOldestClient()
+	}
+}
+
+// trackedClient is a clientLRU entry.
+type trackedClient struct {
+	key      string
+	lastUsed time.Time
+}
+
+// evictOldestClient drops the least recently used client's seen-set and pending batch. Must
+// be called with requestSeenMu held.
+func (s *server) evictOldestClient() {
+	evicted := s.clientLRU.Remove(s.clientLRU.Back()).(*trackedClient).key
+	delete(s.clientLRUIndex, evicted)
+	s.requestSeen.evict(evicted)
+	delete(s.requestPending, evicted)
+}
+
+// expireIdleClients evicts every client not seen for longer than idle and returns how many
+// it dropped. The LRU is ordered by last use, so it only walks the expired tail.
+func (s *server) expireIdleClients(idle time.Duration) int {
+	cutoff := time.Now().Add(-idle)
+	s.requestSeenMu.Lock()
+	defer s.requestSeenMu.Unlock()
+	n := 0
+	for el := s.clientLRU.Back(); el != nil && el.Value.(*trackedClient).lastUsed.Before(cutoff); el = s.clientLRU.Back() {
+		s.evictOldestClient()
+		n++
+	}
+	return n
+}
+
+// runSeenJanitor expires idle clients every interval so seen-state for clients that stopped
+// polling doesn't accumulate until restart.
+func (s *server) runSeenJanitor(idle, interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := s.expireIdleClients(idle); n > 0 {
+			s.seenExpired.Add(int64(n))
+			log.Printf("seen janitor: expired=%d", n)
+		}
+	}
+}
+
+// seenKey namespaces a client's seen-set by device. Without a device, all requests for a client
+// key share one seen-set (the original behavior); with one, each (key, device) pair rotates
+// independently. The NUL separator keeps composite keys from colliding with ordinary ones.
+func seenKey(clientKey, device string) string {
+	if device == "" {
+		return clientKey
+	}
+	return clientKey + "\x00" + device
+}
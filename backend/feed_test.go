@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestTouchClientEvictsLeastRecentlyUsed(t *testing.T) {
+	s := newServer(nil, nil, "")
+	s.maxTrackedClients = 2
+	ctx := context.Background()
+	touch := func(sk string) {
+		s.requestSeenMu.Lock()
+		s.touchClient(sk)
+		s.requestSeenMu.Unlock()
+	}
+	for _, sk := range []string{"first", "second"} {
+		touch(sk)
+		s.requestSeen.markSeen(ctx, sk, []string{sk + ".jpg"})
+		s.requestPending[sk] = []string{sk + ".jpg"}
+	}
+	// Using first again leaves second as the least recently used when third arrives.
+	touch("first")
+	touch("third")
+
+	if _, ok := s.clientLRUIndex["second"]; ok {
+		t.Error("second still in clientLRUIndex")
+	}
+	if _, ok := s.requestPending["second"]; ok {
+		t.Error("second still in requestPending")
+	}
+	if seen, _ := s.requestSeen.seen(ctx, "second"); len(seen) != 0 {
+		t.Errorf("second's seen-set = %v, want empty", seen)
+	}
+	for _, sk := range []string{"first", "third"} {
+		if _, ok := s.clientLRUIndex[sk]; !ok {
+			t.Errorf("%s evicted from clientLRUIndex", sk)
+		}
+	}
+	if seen, _ := s.requestSeen.seen(ctx, "first"); len(seen) != 1 {
+		t.Errorf("first's seen-set = %v, want first.jpg", seen)
+	}
+	if s.clientLRU.Len() != 2 {
+		t.Errorf("clientLRU.Len() = %d, want 2", s.clientLRU.Len())
+	}
+}
+
+func TestPickFeedFixedSeed(t *testing.T) {
+	s := newServer(nil, nil, "")
+	s.rng = rand.New(rand.NewSource(1))
+	pool := []string{"a", "b", "c", "d", "e", "f"}
+	pick := func() []string {
+		t.Helper()
+		out, err := s.pickFeed(context.Background(), "client", "", pool, 3, false, orderRandom, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.urls
+	}
+	if got, want := pick(), []string{"f", "e", "c"}; !slices.Equal(got, want) {
+		t.Fatalf("first batch = %v, want %v", got, want)
+	}
+	// The second batch can only come from what the first left unseen.
+	if got, want := pick(), []string{"b", "d", "a"}; !slices.Equal(got, want) {
+		t.Fatalf("second batch = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// feedEntry is one item of the cached feed list: what feedPool filters on, plus the URL.
+type feedEntry struct {
+	key   string
+	url   string
+	meta  map[string]string
+	taken time.Time // see objectStat.takenOrModified
+}
+
+// feedList returns the materialized feed, rebuilding it if it has been invalidated. The
+// rebuild and store happen under one read lock, and writers invalidate under the write
+// lock, so a list built before a change can never be stored after it.
+func (s *server) feedList() []feedEntry {
+	if l := s.feedCache.Load(); l != nil {
+		return *l
+	}
+	s.feedByKeyMu.RLock()
+	defer s.feedByKeyMu.RUnlock()
+	if l := s.feedCache.Load(); l != nil {
+		return *l
+	}
+	list := make([]feedEntry, 0, len(s.feedByKey))
+	for k, u := range s.feedByKey {
+		list = append(list, feedEntry{key: k, url: u, meta: s.feedMeta[k], taken: s.feedStat[k].takenOrModified()})
+	}
+	s.feedCache.Store(&list)
+	return list
+}
+
+// invalidateFeedCache drops the cached feed list so the next read rebuilds it. Must be
+// called with feedByKeyMu held for writing, after changing the index.
+func (s *server) invalidateFeedCache() {
+	s.feedCache.Store(nil)
+}
+
+// handleCacheInvalidate forces the feed list to be rebuilt and reports its size.
+func (s *server) handleCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	s.feedByKeyMu.Lock()
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	n := len(s.feedList())
+	log.Printf("feed cache invalidated: count=%d", n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"count": n})
+}
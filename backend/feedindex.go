@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectURL returns the feed URL for a bucket key.
+func (s *server) objectURL(key string) string {
+	return s.feedURLBase + "/" + key
+}
+
+// urlKey is the inverse of objectURL and bucketURL.
+func (s *server) urlKey(u string) string {
+	if k, ok := strings.CutPrefix(u, s.feedURLBase+"/"); ok {
+		return k
+	}
+	for _, src := range s.extraBuckets {
+		if k, ok := strings.CutPrefix(u, src.urlBase+"/"); ok {
+			return k
+		}
+	}
+	return u
+}
+
+// listBucket returns every object in the bucket, following continuation tokens.
+func listBucket(ctx context.Context, client *s3.Client, bucket string) ([]types.Object, error) {
+	var objects []types.Object
+	p := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		MaxKeys: aws.Int32(MAX_KEYS),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, out.Contents...)
+	}
+	return objects, nil
+}
+
+// rebuildFeed re-lists every bucket and replaces feedByKey with the result.
+func (s *server) rebuildFeed(ctx context.Context) (int, error) {
+	stats, err := s.listFeed(ctx)
+	if err != nil {
+		return 0, err
+	}
+	next := make(map[string]string, len(stats))
+	for k, st := range stats {
+		next[k] = s.bucketURL(st.bucket, k)
+	}
+	s.feedByKeyMu.Lock()
+	// Listing doesn't return content type, dimensions, capture time or animation; keep what
+	// we already know of photos without a record.
+	for k, st := range stats {
+		if old, ok := s.feedStat[k]; ok && st.contentType == "" {
+			st.contentType, st.width, st.height, st.takenAt, st.animated = old.contentType, old.width, old.height, old.takenAt, old.animated
+			stats[k] = st
+		}
+	}
+	s.feedByKey = next
+	s.feedByID = idIndex(next)
+	s.feedStat = stats
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	if s.syncObjectMetadata {
+		s.syncMetadata(ctx)
+	}
+	s.shareFeedIndex(ctx)
+	return len(next), nil
+}
+
+// refreshFeed re-lists the buckets and merges the result into feedByKey: new keys are added
+// and keys gone from the bucket are removed. Keys uploaded through this server after the
+// listing started are kept even though the listing can't have seen them.
+func (s *server) refreshFeed(ctx context.Context) (added, removed int, err error) {
+	start := time.Now()
+	s.reloadPinned(ctx)
+	s.reloadPhotos(ctx)
+	s.reloadPhotoVotes(ctx)
+	listed, err := s.listFeed(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.feedByKeyMu.Lock()
+	for key, st := range listed {
+		if _, ok := s.feedByKey[key]; !ok {
+			s.setFeedKey(key, s.bucketURL(st.bucket, key))
+			s.feedStat[key] = st
+			added++
+		}
+	}
+	var gone []string
+	for key := range s.feedByKey {
+		if _, ok := listed[key]; !ok && s.feedStat[key].modified.Before(start) {
+			gone = append(gone, key)
+		}
+	}
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	s.removeFromFeed(gone)
+	// The records stay, so a photo restored to the bucket gets its details back.
+	if _, err := s.markPhotos(ctx, gone, photoPublished, photoMissing); err != nil {
+		log.Printf("photo records mark missing: %v", err)
+	}
+	if added > 0 {
+		if s.syncObjectMetadata {
+			s.syncMetadata(ctx)
+		}
+		s.shareFeedIndex(ctx)
+	}
+	return added, len(gone), nil
+}
+
+// runFeedRefresh calls refreshFeed every interval so objects added or deleted outside this
+// server (e.g. in the Cloudflare dashboard) show up in /feed without a restart.
+func (s *server) runFeedRefresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		added, removed, err := s.refreshFeed(context.Background())
+		if err != nil {
+			log.Printf("feed refresh: %v", err)
+			continue
+		}
+		if added > 0 || removed > 0 {
+			log.Printf("feed refresh: added=%d removed=%d", added, removed)
+		}
+	}
+}
+
+// deleteResult is the per-key outcome of a batch delete.
+type deleteResult struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// deleteObjects removes keys from the bucket with DeleteObjects, chunked to the
+// 1000-key-per-call limit, and returns one result per key in input order.
+func deleteObjects(ctx context.Context, client *s3.Client, bucket string, keys []string) []deleteResult {
+	results := make([]deleteResult, len(keys))
+	index := make(map[string]int, len(keys))
+	for i, k := range keys {
+		results[i] = deleteResult{Key: k}
+		index[k] = i
+	}
+	for start := 0; start < len(keys); start += MAX_KEYS {
+		end := min(start+MAX_KEYS, len(keys))
+		ids := make([]types.ObjectIdentifier, 0, end-start)
+		for _, k := range keys[start:end] {
+			ids = append(ids, types.ObjectIdentifier{Key: aws.String(k)})
+		}
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids},
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				results[i].Error = err.Error()
+			}
+			continue
+		}
+		for _, d := range out.Deleted {
+			if i, ok := index[aws.ToString(d.Key)]; ok {
+				results[i].Deleted = true
+			}
+		}
+		for _, e := range out.Errors {
+			if i, ok := index[aws.ToString(e.Key)]; ok {
+				results[i].Error = aws.ToString(e.Code) + ": " + aws.ToString(e.Message)
+			}
+		}
+	}
+	return results
+}
+
+// removeFromFeed drops keys from feedByKey and purges them from every seen-set and pending
+// ack batch.
+func (s *server) removeFromFeed(keys []string) {
+	urls := make([]string, 0, len(keys))
+	s.feedByKeyMu.Lock()
+	for _, k := range keys {
+		if u, ok := s.feedByKey[k]; ok {
+			urls = append(urls, u)
+			delete(s.feedByKey, k)
+			delete(s.feedByID, photoID(k))
+		}
+		delete(s.feedMeta, k)
+		delete(s.feedStat, k)
+	}
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	s.shareFeedRemoval(context.Background(), keys)
+
+	if err := s.requestSeen.purge(context.Background(), keys); err != nil {
+		log.Printf("seen purge: %v", err)
+	}
+	if s.serves != nil {
+		if err := s.serves.forget(context.Background(), keys); err != nil {
+			log.Printf("serve counts purge: %v", err)
+		}
+	}
+	if s.views != nil {
+		if err := s.views.forget(context.Background(), keys); err != nil {
+			log.Printf("view counts purge: %v", err)
+		}
+	}
+	if err := s.forgetUploadHashes(context.Background(), keys); err != nil {
+		log.Printf("upload hashes purge: %v", err)
+	}
+	s.requestSeenMu.Lock()
+	for sk, pending := range s.requestPending {
+		kept := pending[:0]
+		for _, p := range pending {
+			if !slices.Contains(urls, p) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.requestPending, sk)
+		} else {
+			s.requestPending[sk] = kept
+		}
+	}
+	s.requestSeenMu.Unlock()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleHealthz reports liveness along with the R2 breaker state and the idle-client
+// expiry count. It stays 200 while the breaker is open so an orchestrator doesn't restart
+// the process over an upstream outage.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	resp := map[string]interface{}{"status": "ok", "seen_expired": s.seenExpired.Load()}
+	if s.r2Breaker != nil {
+		resp["r2_breaker"] = s.r2Breaker.currentState().String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// heicJPEGQuality is the quality HEIC uploads are converted to JPEG at.
+const heicJPEGQuality = "90"
+
+// convertHEIC converts a HEIC/HEIF image to JPEG with heif-convert (HEIF_CONVERT_PATH),
+// since browsers outside Safari can't show HEIC. heif-convert applies the image's rotation
+// and mirroring, so the JPEG comes out upright.
+func convertHEIC(ctx context.Context, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "heic-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.heic"), filepath.Join(dir, "out.jpg")
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := runTool(ctx, envOr("HEIF_CONVERT_PATH", "heif-convert"), "-q", heicJPEGQuality, in, out); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(out)
+}
+
+// jpegFilename swaps a HEIC filename's extension for .jpg to match the converted file.
+func jpegFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+}
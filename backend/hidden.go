@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// createHiddenTable creates the table of keys hidden from the feed with
+// POST /admin/photos/{key}/hide. Hidden objects stay in the bucket.
+func createHiddenTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS hidden_photos (
+			photo_key TEXT PRIMARY KEY,
+			hidden_at TIMESTAMPTZ DEFAULT NOW()
+		);
+	`)
+	return err
+}
+
+// hiddenKeys returns every hidden key. It's read on each listing rather than cached so a
+// hide on one instance holds on all of them.
+func (s *server) hiddenKeys(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT photo_key FROM hidden_photos`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hidden := make(map[string]bool)
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		hidden[k] = true
+	}
+	return hidden, rows.Err()
+}
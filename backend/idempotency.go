@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxIdempotencyKeyLen bounds the Idempotency-Key header.
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBody is the largest response stored for replay; bigger ones aren't kept.
+	maxIdempotentBody = 64 << 10
+)
+
+// createIdempotencyTable creates the table of responses kept for Idempotency-Key replays.
+// A row with status 0 is a request still in progress.
+func createIdempotencyTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			idem_key TEXT NOT NULL,
+			route TEXT NOT NULL,
+			client TEXT NOT NULL,
+			status INT NOT NULL DEFAULT 0,
+			content_type TEXT NOT NULL DEFAULT '',
+			body BYTEA,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (idem_key, route, client)
+		);
+	`)
+	return err
+}
+
+// idempotencyClaim identifies one Idempotency-Key record: the key is only unique to the
+// client that sent it, so two clients picking the same key don't see each other's responses.
+type idempotencyClaim struct {
+	key, route, client string
+}
+
+// idempotent wraps a POST handler so a request carrying an Idempotency-Key runs once per
+// client, key and route within IDEMPOTENCY_TTL_SEC: retries get the first successful
+// response replayed, marked with Idempotent-Replayed: true, and a retry while the first is
+// still running gets a 409. The client is the key query param, else the IP, as for upload
+// rate limits. Errors and panics aren't kept, so a failed request can be retried for real.
+// Requests without the header, and any when the table can't be reached, run as usual.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			handleError(w, newError(ErrValidation, "Idempotency-Key must be at most 255 characters"))
+			return
+		}
+		c := idempotencyClaim{key: key, route: r.URL.Path, client: "ip:" + clientIP(r)}
+		if k := r.URL.Query().Get("key"); k != "" {
+			c.client = "key:" + k
+		}
+		claimed, err := s.claimIdempotencyKey(r.Context(), c)
+		if err != nil {
+			log.Printf("idempotency claim: key=%s err=%v", key, err)
+			next(w, r)
+			return
+		}
+		if !claimed {
+			s.replayIdempotent(w, r, c)
+			return
+		}
+		rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		// Until the response is recorded the claim is dropped on the way out, so a panicking
+		// handler doesn't leave retries answered with 409 until the record expires.
+		recorded := false
+		defer func() {
+			if !recorded {
+				s.releaseIdempotencyKey(c)
+			}
+		}()
+		next(rec, r)
+		if rec.status >= 300 || rec.overflow {
+			return
+		}
+		// The client may be gone; the outcome still has to be kept for its retry.
+		_, err = s.db.ExecContext(context.Background(), `
+			UPDATE idempotency_keys SET status = $4, content_type = $5, body = $6
+			WHERE idem_key = $1 AND route = $2 AND client = $3
+		`, c.key, c.route, c.client, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+		if err != nil {
+			log.Printf("idempotency record: key=%s err=%v", key, err)
+			return
+		}
+		recorded = true
+	}
+}
+
+// claimIdempotencyKey records c as in progress, reporting false when it's already there. An
+// expired record is replaced.
+func (s *server) claimIdempotencyKey(ctx context.Context, c idempotencyClaim) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM idempotency_keys WHERE idem_key = $1 AND route = $2 AND client = $3 AND created_at < $4
+	`, c.key, c.route, c.client, time.Now().Add(-s.idempotencyTTL)); err != nil {
+		return false, err
+	}
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (idem_key, route, client) VALUES ($1, $2, $3)
+		ON CONFLICT (idem_key, route, client) DO NOTHING
+	`, c.key, c.route, c.client)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// releaseIdempotencyKey drops c's record, so the request can be made again.
+func (s *server) releaseIdempotencyKey(c idempotencyClaim) {
+	_, err := s.db.ExecContext(context.Background(), `
+		DELETE FROM idempotency_keys WHERE idem_key = $1 AND route = $2 AND client = $3
+	`, c.key, c.route, c.client)
+	if err != nil {
+		log.Printf("idempotency release: key=%s err=%v", c.key, err)
+	}
+}
+
+// replayIdempotent writes the response stored for c.
+func (s *server) replayIdempotent(w http.ResponseWriter, r *http.Request, c idempotencyClaim) {
+	var status int
+	var contentType string
+	var body []byte
+	err := s.db.QueryRowContext(r.Context(), `
+		SELECT status, content_type, body FROM idempotency_keys
+		WHERE idem_key = $1 AND route = $2 AND client = $3
+	`, c.key, c.route, c.client).Scan(&status, &contentType, &body)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && status == 0) {
+		// Still running, or it just failed and its claim was dropped.
+		handleError(w, retryError(ErrConflict, "a request with this Idempotency-Key is in progress", time.Second))
+		return
+	}
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "idempotency lookup failed", err))
+		return
+	}
+	log.Printf("idempotent replay: route=%s key=%s client=%s status=%d", c.route, c.key, c.client, status)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// runIdempotencyJanitor deletes expired Idempotency-Key records every interval.
+func (s *server) runIdempotencyJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < $1`, time.Now().Add(-s.idempotencyTTL))
+		if err != nil {
+			log.Printf("idempotency janitor: %v", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("idempotency janitor: expired=%d", n)
+		}
+	}
+}
+
+// responseCapture passes a response through while keeping its status and, up to
+// maxIdempotentBody, its body.
+type responseCapture struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.status, c.wroteHeader = code, true
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	c.wroteHeader = true
+	if c.body.Len()+len(p) > maxIdempotentBody {
+		c.overflow = true
+	} else {
+		c.body.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// photoID is a short opaque ID for key, so clients can refer to a photo without depending
+// on its key or URL. It's a hash, so every instance derives the same ID.
+func photoID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(sum[:9])
+}
+
+// setFeedKey adds or updates key in feedByKey and the ID index. Must be called with
+// feedByKeyMu held.
+func (s *server) setFeedKey(key, u string) {
+	s.feedByKey[key] = u
+	s.feedByID[photoID(key)] = key
+}
+
+// idIndex builds the ID index for a whole feedByKey map.
+func idIndex(byKey map[string]string) map[string]string {
+	ids := make(map[string]string, len(byKey))
+	for k := range byKey {
+		ids[photoID(k)] = k
+	}
+	return ids
+}
+
+// resolvePhoto maps a photo reference from a client, either an ID or a raw key, to its key.
+// References that aren't a known ID are taken as keys.
+func (s *server) resolvePhoto(ref string) string {
+	s.feedByKeyMu.RLock()
+	defer s.feedByKeyMu.RUnlock()
+	if k, ok := s.feedByID[ref]; ok {
+		return k
+	}
+	return ref
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// handleImage streams an object from R2 in proxy mode (IMAGE_PROXY), validating the URL
+// token when signing is enabled.
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/image/")
+	if key == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return
+	}
+	if s.signer != nil {
+		if err := s.signer.verify(key, r.URL.Query()); err != nil {
+			handleError(w, err)
+			return
+		}
+	}
+	s.streamObject(w, r, key)
+}
+
+// streamObject copies an object to the response with its type, length and ETag.
+func (s *server) streamObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, err := s.s3Client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: aws.String(s.keyBucket(key)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			handleError(w, newError(ErrNotFound, "not found"))
+			return
+		}
+		handleError(w, s.r2Error("image fetch failed", fmt.Errorf("key=%s: %w", key, err)))
+		return
+	}
+	defer obj.Body.Close()
+	if obj.ContentType != nil {
+		w.Header().Set("Content-Type", *obj.ContentType)
+	}
+	if obj.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*obj.ContentLength, 10))
+	}
+	if obj.ETag != nil {
+		w.Header().Set("ETag", *obj.ETag)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		log.Printf("image proxy copy: key=%s err=%v", key, err)
+	}
+}
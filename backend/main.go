@@ -2,44 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const MAX_KEYS = 1000
 
-// feedByKey: S3 key -> full URL; used to know if we already have a key when listing again.
-var feedByKey map[string]string
-var feedByKeyMu sync.RWMutex
-
-// requestSeen: client key (query param) -> set of URLs we've already returned to that key.
-var requestSeen map[string]map[string]struct{}
-var requestSeenMu sync.Mutex
-
-// voteRequest is the JSON body for POST /vote.
-type voteRequest struct {
-	Key          string `json:"key"`            // client identifier (who is voting)
-	NamuIsTuxedo bool   `json:"namu_is_tuxedo"` // true if voter thinks namu is the tuxedo cat
-}
-
 func main() {
 	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		log.Fatalln("Error loading .env")
@@ -48,18 +34,67 @@ func main() {
 	accountID := os.Getenv("R2_ACCOUNT_ID")
 	accessKeyID := os.Getenv("R2_ACCESS_KEY_ID")
 	secretKey := os.Getenv("R2_ACCESS_KEY_SECRET")
-	bucket := os.Getenv("R2_BUCKET")
-	publicBaseURL := os.Getenv("R2_PUBLIC_BASE_URL")
+	// R2_BUCKET and R2_PUBLIC_BASE_URL may list several buckets, comma-separated and in the
+	// same order. The first is where uploads go; the rest are merged into the feed read-only.
+	buckets := strings.Split(os.Getenv("R2_BUCKET"), ",")
+	baseURLs := strings.Split(os.Getenv("R2_PUBLIC_BASE_URL"), ",")
+	bucket := strings.TrimSpace(buckets[0])
+	publicBaseURL := strings.TrimSpace(baseURLs[0])
 	for _, v := range []string{accountID, accessKeyID, secretKey, bucket} {
 		if v == "" {
 			log.Fatal("R2_ACCOUNT_ID, R2_ACCESS_KEY_ID, R2_ACCESS_KEY_SECRET, R2_BUCKET must be set")
 		}
 	}
-	if publicBaseURL == "" {
+	// In presign mode the bucket stays private and /feed hands out presigned GET URLs, so
+	// no public base URL is needed.
+	presignURLs := os.Getenv("PRESIGN_URLS") != ""
+	if publicBaseURL == "" && !presignURLs {
 		log.Fatal("R2_PUBLIC_BASE_URL must be set (e.g. https://pub-xxx.r2.dev or custom domain)")
 	}
 	publicBaseURL = strings.TrimSuffix(publicBaseURL, "/")
 
+	// In proxy mode feed URLs point at this server's /image/ endpoint instead of the bucket.
+	imageProxy := os.Getenv("IMAGE_PROXY") != ""
+	if imageProxy && presignURLs {
+		log.Fatal("IMAGE_PROXY and PRESIGN_URLS are mutually exclusive")
+	}
+	feedURLBase := publicBaseURL
+	if presignURLs {
+		// Matches the presigned URLs minus their query, so URLs echoed back (e.g. to
+		// /feed/ack) map to keys the same way as in the other modes.
+		feedURLBase = fmt.Sprintf("https://%s.%s.r2.cloudflarestorage.com", bucket, accountID)
+	}
+	if imageProxy {
+		proxyBaseURL := strings.TrimSuffix(os.Getenv("PROXY_BASE_URL"), "/")
+		if proxyBaseURL == "" {
+			log.Fatal("PROXY_BASE_URL must be set when IMAGE_PROXY is enabled (e.g. https://api.example.com)")
+		}
+		feedURLBase = proxyBaseURL + "/image"
+	}
+	var extraBuckets []bucketSource
+	for i, name := range buckets[1:] {
+		src := bucketSource{name: strings.TrimSpace(name)}
+		switch {
+		case imageProxy:
+			// Proxied URLs don't say which bucket they're from; /image looks it up by key.
+			src.urlBase = feedURLBase
+		case presignURLs:
+			src.urlBase = fmt.Sprintf("https://%s.%s.r2.cloudflarestorage.com", src.name, accountID)
+		case i+1 < len(baseURLs) && strings.TrimSpace(baseURLs[i+1]) != "":
+			src.urlBase = strings.TrimSuffix(strings.TrimSpace(baseURLs[i+1]), "/")
+		default:
+			log.Fatalf("R2_PUBLIC_BASE_URL needs a base URL for bucket %s", src.name)
+		}
+		extraBuckets = append(extraBuckets, src)
+	}
+	var signer *urlSigner
+	if secret := os.Getenv("URL_SIGNING_SECRET"); secret != "" {
+		if !imageProxy {
+			log.Fatal("URL_SIGNING_SECRET requires IMAGE_PROXY")
+		}
+		signer = &urlSigner{secret: []byte(secret)}
+	}
+
 	// PostgreSQL: credentials via env vars (do not commit .env; in production consider a secret manager).
 	databaseURL := os.Getenv("DATABASE_URL")
 	if databaseURL == "" {
@@ -87,6 +122,36 @@ func main() {
 	if err != nil {
 		log.Fatalf("create votes table: %v", err)
 	}
+	if _, err := db.ExecContext(context.Background(), `ALTER TABLE votes ADD COLUMN IF NOT EXISTS reason TEXT`); err != nil {
+		log.Fatalf("migrate votes table: %v", err)
+	}
+	if err := createPhotoVotesTable(context.Background(), db); err != nil {
+		log.Fatalf("create photo_votes table: %v", err)
+	}
+	if err := createVoteEventsTable(context.Background(), db); err != nil {
+		log.Fatalf("create vote_events table: %v", err)
+	}
+	if err := createConsensusSnapshotsTable(context.Background(), db); err != nil {
+		log.Fatalf("create consensus_snapshots table: %v", err)
+	}
+	if err := createHiddenTable(context.Background(), db); err != nil {
+		log.Fatalf("create hidden_photos table: %v", err)
+	}
+	if err := createUploadHashTable(context.Background(), db); err != nil {
+		log.Fatalf("create upload_hashes table: %v", err)
+	}
+	if err := createPhotosTable(context.Background(), db); err != nil {
+		log.Fatalf("create photos table: %v", err)
+	}
+	if err := createPinnedTable(context.Background(), db); err != nil {
+		log.Fatalf("create pinned_photos table: %v", err)
+	}
+	if err := createPendingTable(context.Background(), db); err != nil {
+		log.Fatalf("create pending_photos table: %v", err)
+	}
+	if err := createIdempotencyTable(context.Background(), db); err != nil {
+		log.Fatalf("create idempotency_keys table: %v", err)
+	}
 	log.Print("postgres connected and votes table ready")
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
@@ -97,240 +162,325 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Fail fast while R2 is down instead of tying up every request until it times out.
+	breaker := newCircuitBreaker(envInt("R2_BREAKER_FAILURES", 5), time.Duration(envInt("R2_BREAKER_COOLDOWN_SEC", 30))*time.Second)
 	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID))
+		o.HTTPClient = &breakerHTTPClient{next: o.HTTPClient, breaker: breaker}
 	})
 
-	feedByKey = make(map[string]string)
-	{
-		input := &s3.ListObjectsV2Input{
-			Bucket:  aws.String(bucket),
-			MaxKeys: aws.Int32(MAX_KEYS),
+	srv := newServer(db, s3Client, bucket)
+	srv.r2Breaker = breaker
+	srv.feedURLBase = feedURLBase
+	srv.extraBuckets = extraBuckets
+	if err := srv.loadPinned(context.Background()); err != nil {
+		log.Fatalf("load pinned photos: %v", err)
+	}
+	if err := srv.loadPhotos(context.Background()); err != nil {
+		log.Fatalf("load photo records: %v", err)
+	}
+	if err := srv.loadPhotoVotes(context.Background()); err != nil {
+		log.Fatalf("load photo votes: %v", err)
+	}
+	srv.imageProxy = imageProxy
+	srv.signer = signer
+	if presignURLs {
+		srv.presigner = s3.NewPresignClient(s3Client)
+	}
+	srv.maxTrackedClients = envInt("MAX_TRACKED_CLIENTS", 100000)
+	srv.maxUploadBytes = int64(envInt("MAX_UPLOAD_BYTES", 10<<20))
+	srv.maxVideoUploadBytes = int64(envInt("MAX_VIDEO_UPLOAD_BYTES", 50<<20))
+	srv.multipartThreshold = int64(envInt("MULTIPART_THRESHOLD_BYTES", 16<<20))
+	srv.multipartPartSize = int64(max(envInt("MULTIPART_PART_SIZE_BYTES", 8<<20), minPartSize))
+	srv.multipartConcurrency = max(envInt("MULTIPART_CONCURRENCY", 4), 1)
+	srv.maxImageDim = envInt("MAX_IMAGE_DIMENSION", 6000)
+	if srv.oversizeMode, err = parseOversizeMode(os.Getenv("IMAGE_OVERSIZE")); err != nil {
+		log.Fatalf("IMAGE_OVERSIZE: %v", err)
+	}
+	srv.maxGIFFrames = envInt("MAX_GIF_FRAMES", 300)
+	srv.maxGIFPixels = int64(envInt("MAX_GIF_PIXELS", 100_000_000))
+	srv.thumbMaxDim = envInt("THUMBNAIL_MAX_DIM", 400)
+	srv.renditionSizes = parseRenditionSizes("256,1024")
+	if v, ok := os.LookupEnv("RENDITION_SIZES"); ok {
+		srv.renditionSizes = parseRenditionSizes(v)
+	}
+	if srv.transcodeFormats, err = parseTranscodeFormats(os.Getenv("TRANSCODE_FORMATS")); err != nil {
+		log.Fatalf("TRANSCODE_FORMATS: %v", err)
+	}
+	if srv.exifStrip, err = parseExifStrip(os.Getenv("EXIF_STRIP")); err != nil {
+		log.Fatalf("EXIF_STRIP: %v", err)
+	}
+	srv.objectCacheControl = strings.TrimSpace(os.Getenv("OBJECT_CACHE_CONTROL"))
+	if srv.objectDisposition, err = parseContentDisposition(strings.TrimSpace(os.Getenv("CONTENT_DISPOSITION"))); err != nil {
+		log.Fatalf("CONTENT_DISPOSITION: %v", err)
+	}
+	srv.widgetFrameAncestors = "*"
+	if v := strings.TrimSpace(os.Getenv("WIDGET_FRAME_ANCESTORS")); v != "" {
+		srv.widgetFrameAncestors = v
+	}
+	// Redis is only connected when a store below asks for it.
+	var rdb *redis.Client
+	redisClient := func() *redis.Client {
+		if rdb == nil {
+			opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+			if err != nil {
+				log.Fatalf("REDIS_URL: %v", err)
+			}
+			rdb = redis.NewClient(opts)
+			if err := rdb.Ping(context.Background()).Err(); err != nil {
+				log.Fatalf("redis ping: %v", err)
+			}
 		}
-		out, err := s3Client.ListObjectsV2(context.TODO(), input)
+		return rdb
+	}
+	switch store := os.Getenv("SEEN_STORE"); store {
+	case "", "memory":
+	case "redis":
+		srv.requestSeen = &redisSeenStore{rdb: redisClient()}
+		log.Print("feed seen-state stored in redis")
+	case "postgres":
+		pgStore, err := newPostgresSeenStore(context.Background(), db)
 		if err != nil {
-			log.Fatalf("startup list objects: %v", err)
+			log.Fatalf("create feed_seen table: %v", err)
 		}
-		for _, obj := range out.Contents {
-			if obj.Key != nil && *obj.Key != "" {
-				key := *obj.Key
-				if _, ok := feedByKey[key]; !ok {
-					feedByKey[key] = publicBaseURL + "/" + key
-				}
-			}
+		srv.requestSeen = pgStore
+		log.Print("feed seen-state stored in postgres")
+	default:
+		log.Fatalf("unknown SEEN_STORE %q (want memory, postgres or redis)", store)
+	}
+	if os.Getenv("FAIR_ROTATION") != "" {
+		serves, err := newServeCounter(context.Background(), db)
+		if err != nil {
+			log.Fatalf("create photo_serves table: %v", err)
 		}
-		log.Printf("loaded %d feed URLs at startup", len(feedByKey))
+		srv.serves = serves
+		log.Print("fair feed rotation enabled")
 	}
-	requestSeen = make(map[string]map[string]struct{})
-
-	corsMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			if r.Method == http.MethodOptions {
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			next.ServeHTTP(w, r)
-		})
+	views, err := newViewCounter(context.Background(), db, time.Duration(envInt("VIEW_RETENTION_DAYS", 30))*24*time.Hour)
+	if err != nil {
+		log.Fatalf("create photo_views table: %v", err)
+	}
+	srv.views = views
+	go views.run(time.Duration(max(envInt("VIEW_FLUSH_INTERVAL_SEC", 10), 1)) * time.Second)
+	switch store := os.Getenv("FEED_INDEX_STORE"); store {
+	case "", "memory":
+	case "redis":
+		srv.feedIndex = &redisFeedIndex{rdb: redisClient()}
+		log.Print("feed index shared via redis")
+	default:
+		log.Fatalf("unknown FEED_INDEX_STORE %q (want memory or redis)", store)
 	}
 
-	http.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		limit := 5
-		if l := r.URL.Query().Get("limit"); l != "" {
-			if n, err := strconv.Atoi(l); err == nil && n > 0 {
-				limit = n
-			}
-		}
-
-		clientKey := r.URL.Query().Get("key")
-		if clientKey == "" {
-			http.Error(w, "key required", http.StatusBadRequest)
-			return
-		}
+	srv.syncObjectMetadata = os.Getenv("SYNC_OBJECT_METADATA") != ""
+	srv.keepUploadFilenames = os.Getenv("KEEP_UPLOAD_FILENAMES") != ""
+	srv.requireApproval = os.Getenv("REQUIRE_APPROVAL") != ""
+	if srv.uploadOverwrite, err = parseUploadOverwrite(os.Getenv("UPLOAD_OVERWRITE")); err != nil {
+		log.Fatalf("UPLOAD_OVERWRITE: %v", err)
+	}
+	if srv.uploadOverwrite == overwriteVersion {
+		srv.checkBucketVersioning(context.Background())
+	}
+	if srv.moderator, err = newModerator(context.Background()); err != nil {
+		log.Fatalf("MODERATION: %v", err)
+	}
+	if srv.virusScanner, err = newVirusScanner(); err != nil {
+		log.Fatalf("VIRUS_SCAN: %v", err)
+	}
+	if srv.webhooks, err = newWebhookSender(); err != nil {
+		log.Fatalf("WEBHOOK_URLS: %v", err)
+	}
 
-		feedByKeyMu.RLock()
-		allURLs := make([]string, 0, len(feedByKey))
-		for _, u := range feedByKey {
-			allURLs = append(allURLs, u)
+	// With a snapshot the feed is served from it straight away and reconciled against the
+	// bucket in the background; otherwise (or if it's unusable) list the bucket up front.
+	snapshotFile := os.Getenv("FEED_SNAPSHOT_FILE")
+	fromSnapshot := false
+	if snapshotFile != "" {
+		maxAge := time.Duration(envInt("FEED_SNAPSHOT_MAX_AGE_SEC", 86400)) * time.Second
+		if n, err := srv.loadSnapshot(snapshotFile, maxAge); err != nil {
+			log.Printf("feed snapshot not used, listing bucket: %v", err)
+		} else {
+			fromSnapshot = true
+			log.Printf("loaded %d feed URLs from snapshot %s", n, snapshotFile)
+			go srv.reconcileFromBucket(snapshotFile)
 		}
-		feedByKeyMu.RUnlock()
-		n := len(allURLs)
-		if n == 0 {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{"urls": []string{}})
-			return
+	}
+	if !fromSnapshot {
+		listed, err := srv.listFeed(context.TODO())
+		if err != nil {
+			log.Fatalf("startup list objects: %v", err)
 		}
-		if limit > n {
-			limit = n
+		for key, st := range listed {
+			srv.setFeedKey(key, srv.bucketURL(st.bucket, key))
+			srv.feedStat[key] = st
 		}
-
-		requestSeenMu.Lock()
-		seen, ok := requestSeen[clientKey]
-		if !ok {
-			seen = make(map[string]struct{})
-			requestSeen[clientKey] = seen
+		log.Printf("loaded %d feed URLs at startup", len(srv.feedByKey))
+		if srv.syncObjectMetadata {
+			srv.syncMetadata(context.TODO())
 		}
-		available := make([]string, 0, n)
-		for _, u := range allURLs {
-			if _, sent := seen[u]; !sent {
-				available = append(available, u)
-			}
-		}
-		if len(available) == 0 {
-			for u := range seen {
-				delete(seen, u)
-			}
-			available = append(available[:0], allURLs...)
+	}
+	go func() {
+		n, err := srv.backfillPhotos(context.Background())
+		if err != nil {
+			log.Printf("photo backfill: %v", err)
+		} else if n > 0 {
+			log.Printf("photo backfill: recorded=%d", n)
 		}
+	}()
+	if srv.feedIndex != nil {
+		// This instance's listing is authoritative at startup; after that, follow changes
+		// made by any instance.
+		srv.shareFeedIndex(context.Background())
+		srv.feedIndex.subscribe(context.Background(), func() {
+			srv.reloadFeedIndex(context.Background())
+		})
+	}
+	if idle := envInt("SEEN_IDLE_TTL_SEC", 7*86400); idle > 0 {
+		ttl := time.Duration(idle) * time.Second
+		go srv.runSeenJanitor(ttl, min(ttl, 5*time.Minute))
+	}
+	srv.idempotencyTTL = time.Duration(envInt("IDEMPOTENCY_TTL_SEC", 86400)) * time.Second
+	go srv.runIdempotencyJanitor(min(srv.idempotencyTTL, time.Hour))
+	if interval := envInt("CONSENSUS_SNAPSHOT_INTERVAL_SEC", 600); interval > 0 {
+		go srv.runConsensusSnapshots(time.Duration(interval) * time.Second)
+	}
+	if interval := envInt("FEED_REFRESH_INTERVAL_SEC", 300); interval > 0 {
+		go srv.runFeedRefresh(time.Duration(interval) * time.Second)
+	}
+	if snapshotFile != "" {
+		go srv.runSnapshots(snapshotFile, time.Duration(envInt("FEED_SNAPSHOT_INTERVAL_SEC", 300))*time.Second)
+	}
+	if os.Getenv("PUBLIC_URL_SELF_CHECK") != "" && !imageProxy && !presignURLs {
+		srv.checkPublicBaseURL()
+	}
+	if os.Getenv("MAINTENANCE_MODE") != "" {
+		srv.maintenance.Store(true)
+		log.Print("starting in maintenance mode: writes disabled")
+	}
 
-		log.Printf("new request: key=%s limit=%d available=%d seen=%d", clientKey, limit, len(available), len(seen))
+	settings.Store(loadTunables())
 
-		count := limit
-		if count > len(available) {
-			count = len(available)
-		}
-		idx := rand.Perm(len(available))
-		out := make([]string, count)
-		for i := 0; i < count; i++ {
-			u := available[idx[i]]
-			out[i] = u
-			seen[u] = struct{}{}
-		}
-		requestSeenMu.Unlock()
+	// Per-client-key limit on /feed; a limit of 0 disables it.
+	srv.feedLimiter = newWindowLimiter(currentTunables().FeedRateLimitPerMin, time.Minute)
+	// Opt-in: many voters can legitimately share one IP behind a NAT.
+	srv.voteIPLimiter = newDistinctLimiter(currentTunables().VoteIPMaxKeys, time.Duration(envInt("VOTE_IP_WINDOW_SEC", 3600))*time.Second)
+	// Per-client uploads, so one misbehaving client can't fill the bucket.
+	srv.uploadLimiter = newTokenLimiter(currentTunables().UploadRatePerMin, currentTunables().UploadBurst)
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"urls": out})
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = ".env"
+	}
+	watchReload(configFile, func(t *tunables) {
+		srv.feedLimiter.setLimit(t.FeedRateLimitPerMin)
+		srv.voteIPLimiter.setLimit(t.VoteIPMaxKeys)
+		srv.uploadLimiter.setLimit(t.UploadRatePerMin, t.UploadBurst)
 	})
 
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	// Long-lived polling clients benefit from reused connections. Write timeout defaults to
+	// off since uploads can be slow.
+	var handler http.Handler = loggingMiddleware(compressMiddleware(corsMiddleware(srv.routes())))
+	idleTimeout := time.Duration(envInt("HTTP_IDLE_TIMEOUT_SEC", 120)) * time.Second
+	if os.Getenv("H2C") != "" {
+		// Cleartext HTTP/2 for deployments behind a proxy that speaks h2c upstream.
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: idleTimeout})
+	}
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(envInt("HTTP_READ_HEADER_TIMEOUT_SEC", 10)) * time.Second,
+		ReadTimeout:       time.Duration(envInt("HTTP_READ_TIMEOUT_SEC", 0)) * time.Second,
+		WriteTimeout:      time.Duration(envInt("HTTP_WRITE_TIMEOUT_SEC", 0)) * time.Second,
+		IdleTimeout:       idleTimeout,
+	}
 
-		file, header, err := r.FormFile("image")
-		if err != nil {
-			http.Error(w, "missing or invalid form field 'image'", http.StatusBadRequest)
-			return
+	// Optional direct HTTPS for deployments without a TLS-terminating proxy.
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			log.Fatalf("load TLS certificate: %v", err)
 		}
-		defer file.Close()
-
-		contentType := header.Header.Get("Content-Type")
-		if contentType == "" {
-			contentType = "application/octet-stream"
+		if redirectPort := os.Getenv("HTTP_REDIRECT_PORT"); redirectPort != "" {
+			go func() {
+				log.Printf("redirecting http://localhost:%s to https", redirectPort)
+				log.Fatal(http.ListenAndServe(":"+redirectPort, httpsRedirect(port)))
+			}()
 		}
+		log.Printf("listening on https://localhost:%s", port)
+		log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+	}
+	log.Printf("listening on http://localhost:%s", port)
+	log.Fatal(server.ListenAndServe())
+}
 
-		key := filepath.Base(header.Filename)
-		if key == "" || key == "." {
-			ext := strings.ToLower(filepath.Ext(header.Filename))
-			if ext == "" {
-				ext = ".jpg"
-			}
-			key = fmt.Sprintf("%s-%s%s", time.Now().Format("2006-01-02"), time.Now().Format("150405"), ext)
+// httpsRedirect permanently redirects every request to the same host and path over HTTPS
+// on tlsPort.
+func httpsRedirect(tlsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
 		}
-		log.Printf("new file received: filename=%s key=%s", header.Filename, key)
-
-		_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket:      aws.String(bucket),
-			Key:         aws.String(key),
-			Body:        file,
-			ContentType: aws.String(contentType),
-			ACL:         types.ObjectCannedACLPublicRead,
-		})
-		if err != nil {
-			log.Printf("upload failed: %v", err)
-			http.Error(w, "upload failed", http.StatusInternalServerError)
-			return
+		if tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
 		}
-		feedByKeyMu.Lock()
-		feedByKey[key] = publicBaseURL + "/" + key
-		feedByKeyMu.Unlock()
-		log.Printf("successfully uploaded to R2: key=%s", key)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"key": key})
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 	})
+}
 
-	http.HandleFunc("/vote", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var req voteRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid JSON", http.StatusBadRequest)
-			return
-		}
-		if req.Key == "" {
-			http.Error(w, "key required", http.StatusBadRequest)
-			return
-		}
-		_, err := db.ExecContext(context.Background(),
-			`INSERT INTO votes (key, namu_is_tuxedo, vote_count) VALUES ($1, $2, 1)
-			 ON CONFLICT (key) DO UPDATE SET namu_is_tuxedo = $2, updated_at = NOW(), vote_count = votes.vote_count + 1`,
-			req.Key, req.NamuIsTuxedo)
-		if err != nil {
-			log.Printf("vote insert: %v", err)
-			http.Error(w, "vote failed", http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"ok": "voted"})
-	})
+// envInt reads an integer env var, falling back to def when unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
 
-	http.HandleFunc("/consensus", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		rows, err := db.QueryContext(context.Background(), `
-			SELECT namu_is_tuxedo, COUNT(*) AS cnt
-			FROM votes
-			GROUP BY namu_is_tuxedo
-		`)
-		if err != nil {
-			log.Printf("consensus query: %v", err)
-			http.Error(w, "consensus failed", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-		var namuTuxedoCount, namuNotTuxedoCount int64
-		for rows.Next() {
-			var isTuxedo bool
-			var cnt int64
-			if err := rows.Scan(&isTuxedo, &cnt); err != nil {
-				log.Printf("consensus scan: %v", err)
-				http.Error(w, "consensus failed", http.StatusInternalServerError)
-				return
-			}
-			if isTuxedo {
-				namuTuxedoCount = cnt
-			} else {
-				namuNotTuxedoCount = cnt
-			}
-		}
-		if err := rows.Err(); err != nil {
-			log.Printf("consensus rows: %v", err)
-			http.Error(w, "consensus failed", http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"namu_is_tuxedo":     namuTuxedoCount,
-			"namu_is_not_tuxedo": namuNotTuxedoCount,
-		})
-	})
+// checkPublicBaseURL fetches one known feed URL and logs a warning if it isn't served,
+// which usually means R2_PUBLIC_BASE_URL points at a bucket that isn't publicly readable.
+func (s *server) checkPublicBaseURL() {
+	var u string
+	s.feedByKeyMu.RLock()
+	for _, v := range s.feedByKey {
+		u = v
+		break
+	}
+	s.feedByKeyMu.RUnlock()
+	if u == "" {
+		log.Print("public URL self-check skipped: bucket is empty")
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		log.Printf("warning: public URL self-check failed: url=%s err=%v", u, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("warning: public URL self-check failed: url=%s status=%d (is R2_PUBLIC_BASE_URL public?)", u, resp.StatusCode)
+		return
+	}
+	log.Printf("public URL self-check ok: url=%s", u)
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// envOr reads a string env var, falling back to def when unset or empty.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
-	log.Printf("listening on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, corsMiddleware(http.DefaultServeMux)))
+	return def
 }
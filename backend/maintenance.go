@@ -0,0 +1,15 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// rejectIfMaintenance writes a 503 and returns true when maintenance mode is on.
+func (s *server) rejectIfMaintenance(w http.ResponseWriter) bool {
+	if !s.maintenance.Load() {
+		return false
+	}
+	handleError(w, retryError(ErrUnavailable, "service is in maintenance mode; writes are temporarily disabled", 5*time.Minute))
+	return true
+}
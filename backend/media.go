@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// mediaExtensions covers media types that the system MIME table may lack, as it does in slim
+// containers for most video formats.
+var mediaExtensions = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+}
+
+// mediaKind is the /feed item type for a content type: "video" or "image".
+func mediaKind(typ string) string {
+	if strings.HasPrefix(typ, "video/") {
+		return "video"
+	}
+	return "image"
+}
+
+// isMediaType reports whether typ is something the frontend can render.
+func isMediaType(typ string) bool {
+	return strings.HasPrefix(typ, "image/") || strings.HasPrefix(typ, "video/")
+}
+
+// uploadTypes are the content types accepted for upload, as detected from the file itself.
+var uploadTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/heic", // converted to JPEG before storing; see convertHEIC
+	"video/mp4",
+	"video/quicktime",
+	"video/webm",
+}
+
+// mp4Brands are ftyp major brands of MP4 files that http.DetectContentType misses because
+// "mp4" isn't among their compatible brands, as with many phone recordings.
+var mp4Brands = []string{"isom", "iso2", "avc1", "mp41", "mp42", "M4V ", "3gp4", "3gp5"}
+
+// heicBrands are ftyp major brands of HEIC/HEIF stills, as iPhones write them.
+var heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+// detectMediaType identifies a file from its first bytes (up to 512). It extends
+// http.DetectContentType with QuickTime, HEIC and more MP4 brands, which it reports as
+// octet-stream.
+func detectMediaType(head []byte) string {
+	if len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) {
+		switch brand := string(head[8:12]); {
+		case brand == "qt  ":
+			return "video/quicktime"
+		case slices.Contains(mp4Brands, brand):
+			return "video/mp4"
+		case slices.Contains(heicBrands, brand):
+			return "image/heic"
+		}
+	}
+	typ := http.DetectContentType(head)
+	if i := strings.IndexByte(typ, ';'); i >= 0 {
+		typ = typ[:i]
+	}
+	return typ
+}
+
+// checkUploadType returns an error unless typ is one of uploadTypes.
+func checkUploadType(typ string) error {
+	if !slices.Contains(uploadTypes, typ) {
+		return newError(ErrUnsupportedType, "unsupported file type "+typ+"; accepted types are "+strings.Join(uploadTypes, ", "))
+	}
+	return nil
+}
+
+// mediaObjects drops objects that aren't renderable media (manifests, .DS_Store, ...) from a
+// bucket listing so they never reach /feed. Keys are judged by extension; keys without one
+// use the content type already in the index, or are HEADed for it. A failed HEAD keeps the
+// object so a transient error doesn't drop a photo from the feed. The bucket's cached
+// non-media keys are replaced with those found in this listing, so deleted ones drop out.
+func (s *server) mediaObjects(ctx context.Context, bucket string, objects []types.Object) []types.Object {
+	s.nonMediaMu.Lock()
+	known := s.nonMedia[bucket]
+	s.nonMediaMu.Unlock()
+	nonMedia := make(map[string]string)
+	kept := objects[:0]
+	var skipped int
+	for _, obj := range objects {
+		if s.isMediaKey(ctx, bucket, obj, known, nonMedia) {
+			kept = append(kept, obj)
+		} else {
+			skipped++
+		}
+	}
+	s.nonMediaMu.Lock()
+	s.nonMedia[bucket] = nonMedia
+	s.nonMediaMu.Unlock()
+	if skipped > 0 {
+		log.Printf("feed listing: skipped %d non-media objects", skipped)
+	}
+	return kept
+}
+
+// isMediaKey reports whether obj is renderable media (see mediaObjects). Extensionless keys a
+// HEAD found not to be media are added to nonMedia; those already in known at the same
+// version aren't HEADed again.
+func (s *server) isMediaKey(ctx context.Context, bucket string, obj types.Object, known, nonMedia map[string]string) bool {
+	key := aws.ToString(obj.Key)
+	if path.Ext(key) != "" {
+		return isMediaType(guessContentType(key))
+	}
+	s.feedByKeyMu.RLock()
+	typ := s.feedStat[key].contentType
+	s.feedByKeyMu.RUnlock()
+	if typ != "" {
+		return isMediaType(typ)
+	}
+	version := objectVersion(obj)
+	if v, ok := known[key]; ok && v == version {
+		nonMedia[key] = version
+		return false
+	}
+	out, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("feed listing head: key=%s err=%v", key, err)
+		return true
+	}
+	if !isMediaType(aws.ToString(out.ContentType)) {
+		nonMedia[key] = version
+		return false
+	}
+	return true
+}
+
+// objectVersion identifies a listed object's content: its ETag, with the last-modified time
+// in case a store leaves the ETag out.
+func objectVersion(obj types.Object) string {
+	return aws.ToString(obj.ETag) + "@" + aws.ToTime(obj.LastModified).UTC().Format(time.RFC3339Nano)
+}
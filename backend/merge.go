@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// mergePhotoVotes moves from's votes onto to in one transaction, returning how many rows
+// moved. A client that voted on both keeps its vote on to; its vote on from is dropped and
+// counted in dropped.
+func (s *server) mergePhotoVotes(ctx context.Context, from, to string) (moved, dropped int64, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE photo_votes SET photo_key = $2, updated_at = NOW()
+		WHERE photo_key = $1 AND key NOT IN (SELECT key FROM photo_votes WHERE photo_key = $2)
+	`, from, to)
+	if err != nil {
+		return 0, 0, fmt.Errorf("move: %w", err)
+	}
+	if moved, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	res, err = tx.ExecContext(ctx, `DELETE FROM photo_votes WHERE photo_key = $1`, from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("drop: %w", err)
+	}
+	if dropped, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	return moved, dropped, tx.Commit()
+}
+
+// handleMergePhotos serves POST /admin/merge-photos (body: {"from": key, "to": key}), the
+// repair for a photo uploaded twice: from's votes are moved onto to, then from is deleted.
+// Either may be a photo ID. The response reports the vote rows moved and dropped, and
+// whether the duplicate was deleted; the votes stay merged even if the delete fails.
+func (s *server) handleMergePhotos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON"))
+		return
+	}
+	from, to := s.resolvePhoto(req.From), s.resolvePhoto(req.To)
+	if from == "" || to == "" {
+		handleError(w, newError(ErrValidation, "from and to required"))
+		return
+	}
+	if from == to {
+		handleError(w, newError(ErrValidation, "from and to must be different photos"))
+		return
+	}
+	for _, k := range []string{from, to} {
+		if _, ok := s.recordFor(k); !ok {
+			handleError(w, newError(ErrNotFound, "no photo "+k))
+			return
+		}
+	}
+	moved, dropped, err := s.mergePhotoVotes(r.Context(), from, to)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "merge failed", err))
+		return
+	}
+	s.reloadPhotoVotes(r.Context())
+	results, _ := s.deletePhotos(r.Context(), []string{from})
+	log.Printf("photos merged: from=%s to=%s moved=%d dropped=%d deleted=%t", from, to, moved, dropped, results[0].Deleted)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":          from,
+		"to":            to,
+		"votes_moved":   moved,
+		"votes_dropped": dropped,
+		"deleted":       results[0],
+		"cat_votes":     s.photoTally(to),
+	})
+}
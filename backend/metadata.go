@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// uploadMetaPrefix marks multipart form fields stored as object metadata (meta_mood=sleepy).
+	uploadMetaPrefix = "meta_"
+	// feedMetaPrefix marks /feed query params that filter on metadata (meta.mood=sleepy).
+	feedMetaPrefix = "meta."
+	// maxMetadataBytes stays under the 2 KB S3 limit on user-defined metadata.
+	maxMetadataBytes = 2048
+	// widthMetaName and heightMetaName hold the pixel dimensions recorded at upload. They're
+	// kept out of feedMeta and surfaced as item fields instead.
+	widthMetaName  = "width"
+	heightMetaName = "height"
+	// takenAtMetaName holds the EXIF capture time (RFC 3339), likewise surfaced as a field, as
+	// is animatedMetaName.
+	takenAtMetaName = "taken_at"
+	// catMetaName is the metadata name the cat tag is stored under, so /feed?cat=namu is
+	// shorthand for filtering on meta.cat.
+	catMetaName = "cat"
+)
+
+// cats are the accepted cat tags; "both" matches a filter for either cat.
+var cats = []string{"namu", "rocky", "both"}
+
+// parseCat validates a cat tag from an upload; an empty tag is allowed.
+func parseCat(c string) (string, error) {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if c == "" || slices.Contains(cats, c) {
+		return c, nil
+	}
+	return "", newError(ErrValidation, "cat must be one of "+strings.Join(cats, ", "))
+}
+
+// matchesCat reports whether meta's cat tag satisfies a /feed cat filter.
+func matchesCat(meta map[string]string, cat string) bool {
+	tag := meta[catMetaName]
+	return tag == cat || tag == "both"
+}
+
+// parseUploadMetadata collects meta_* form fields, plus the cat tag field, into an object
+// metadata map.
+func parseUploadMetadata(form url.Values) (map[string]string, error) {
+	meta := make(map[string]string)
+	size := 0
+	for field, vals := range form {
+		name, ok := strings.CutPrefix(field, uploadMetaPrefix)
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		name = strings.ToLower(name)
+		if !validMetaName(name) {
+			return nil, newError(ErrValidation, fmt.Sprintf("invalid metadata name %q", name))
+		}
+		v := strings.TrimSpace(vals[0])
+		size += len(name) + len(v)
+		meta[name] = v
+	}
+	if size > maxMetadataBytes {
+		return nil, newError(ErrValidation, fmt.Sprintf("metadata exceeds %d bytes", maxMetadataBytes))
+	}
+	if vals := form[catMetaName]; len(vals) > 0 {
+		cat, err := parseCat(vals[0])
+		if err != nil {
+			return nil, err
+		}
+		if cat != "" {
+			meta[catMetaName] = cat
+		}
+	}
+	return meta, nil
+}
+
+func validMetaName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// metaFilters extracts meta.* params from a /feed query.
+func metaFilters(q url.Values) map[string]string {
+	var filters map[string]string
+	for param, vals := range q {
+		name, ok := strings.CutPrefix(param, feedMetaPrefix)
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		if filters == nil {
+			filters = make(map[string]string)
+		}
+		filters[strings.ToLower(name)] = vals[0]
+	}
+	return filters
+}
+
+// matchesMeta reports whether meta has every name=value pair in filters (values compare
+// case-insensitively).
+func matchesMeta(meta, filters map[string]string) bool {
+	for name, want := range filters {
+		if !strings.EqualFold(meta[name], want) {
+			return false
+		}
+	}
+	return true
+}
+
+// headResult is what syncMetadata learns from one HeadObject call.
+type headResult struct {
+	meta          map[string]string
+	contentType   string
+	width, height int
+	takenAt       time.Time
+	animated      bool
+}
+
+// headMetadata HEADs key for its user metadata, splitting out the dimensions and capture
+// time stored with it.
+func (s *server) headMetadata(ctx context.Context, key string) (headResult, error) {
+	out, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.keyBucket(key)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return headResult{}, err
+	}
+	res := headResult{meta: make(map[string]string, len(out.Metadata)), contentType: aws.ToString(out.ContentType)}
+	for name, v := range out.Metadata {
+		switch name {
+		case widthMetaName:
+			res.width, _ = strconv.Atoi(v)
+		case heightMetaName:
+			res.height, _ = strconv.Atoi(v)
+		case takenAtMetaName:
+			res.takenAt, _ = time.Parse(time.RFC3339, v)
+		case animatedMetaName:
+			res.animated = v == "true"
+		default:
+			res.meta[name] = v
+		}
+	}
+	return res, nil
+}
+
+// syncMetadata HEADs every key in feedByKey and refreshes feedMeta along with the content
+// type and dimensions in feedStat.
+func (s *server) syncMetadata(ctx context.Context) {
+	s.feedByKeyMu.RLock()
+	keys := make([]string, 0, len(s.feedByKey))
+	for k := range s.feedByKey {
+		keys = append(keys, k)
+	}
+	s.feedByKeyMu.RUnlock()
+
+	var mu sync.Mutex
+	fetched := make(map[string]headResult, len(keys))
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				res, err := s.headMetadata(ctx, k)
+				if err != nil {
+					log.Printf("metadata sync head: key=%s err=%v", k, err)
+					continue
+				}
+				mu.Lock()
+				fetched[k] = res
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, k := range keys {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+
+	withMeta := 0
+	s.feedByKeyMu.Lock()
+	for k, res := range fetched {
+		if len(res.meta) > 0 {
+			s.feedMeta[k] = res.meta
+			withMeta++
+		} else {
+			delete(s.feedMeta, k)
+		}
+		if st, ok := s.feedStat[k]; ok {
+			st.contentType, st.width, st.height, st.takenAt, st.animated = res.contentType, res.width, res.height, res.takenAt, res.animated
+			s.feedStat[k] = st
+		}
+	}
+	for k := range s.feedMeta {
+		if _, ok := s.feedByKey[k]; !ok {
+			delete(s.feedMeta, k)
+		}
+	}
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	log.Printf("metadata sync: objects=%d with_metadata=%d", len(keys), withMeta)
+}
+
+// setObjectMetadata adds metadata entries to a primary-bucket object by copying it onto
+// itself, which is the only way S3 allows metadata to change.
+func (s *server) setObjectMetadata(ctx context.Context, key string, add map[string]string) error {
+	head, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	meta := make(map[string]string, len(head.Metadata)+len(add))
+	for k, v := range head.Metadata {
+		meta[k] = v
+	}
+	for k, v := range add {
+		meta[k] = v
+	}
+	_, err = s.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:             aws.String(s.bucket),
+		Key:                aws.String(key),
+		CopySource:         aws.String(s.bucket + "/" + url.PathEscape(key)),
+		ContentType:        head.ContentType,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		Metadata:           meta,
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		ACL:                types.ObjectCannedACLPublicRead,
+	})
+	return err
+}
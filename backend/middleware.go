@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, X-Max-Upload-Bytes, X-Max-Video-Upload-Bytes, Idempotent-Replayed")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets /ws upgrade through the middleware.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// loggingMiddleware times each request and logs a warning for any that take longer than
+// SLOW_REQUEST_MS. A zero threshold disables slow-request logging.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		d := time.Since(start)
+		if slow := currentTunables().SlowRequest; slow > 0 && d > slow {
+			object, ok := strings.CutPrefix(r.URL.Path, "/image/")
+			if !ok {
+				object = ""
+			}
+			log.Printf("warning: slow request: method=%s route=%s status=%d duration=%s key=%s object=%s",
+				r.Method, r.URL.Path, rec.status, d, r.URL.Query().Get("key"), object)
+		}
+	})
+}
+
+// compressibleTypes are the response content types compressMiddleware will encode. Images
+// and video are already compressed, and event streams are left alone so each event reaches
+// the client as soon as it's written.
+var compressibleTypes = []string{
+	"application/json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"text/csv",
+	"text/plain",
+	"text/html",
+	"text/xml",
+}
+
+// compressMiddleware gzip- or deflate-encodes responses for clients that accept it, when the
+// handler's Content-Type is in compressibleTypes.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding picks gzip over deflate from an Accept-Encoding header, ignoring q-values
+// other than an explicit q=0.
+func acceptedEncoding(header string) string {
+	var deflate bool
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+	if deflate {
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter decides whether to compress when the headers are written, based on the
+// Content-Type the handler set.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser // nil when passing through
+	wroteHeader bool
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	typ, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	if h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified &&
+		slices.Contains(compressibleTypes, strings.TrimSpace(typ)) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if c.encoding == "gzip" {
+			c.enc = gzip.NewWriter(c.ResponseWriter)
+		} else {
+			c.enc, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Flush() {
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close flushes any buffered compressed output.
+func (c *compressWriter) Close() error {
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// quarantinePrefix holds uploads moderation rejected, at quarantine/{key}. They're private
+// and never feed items; admins review them with GET /admin/quarantine (see handleQuarantine).
+const quarantinePrefix = "quarantine/"
+
+// moderationTimeout bounds one moderation check.
+const moderationTimeout = 30 * time.Second
+
+// moderator decides whether an uploaded image may go live (MODERATION).
+type moderator interface {
+	// check returns why the image should be quarantined, or "" to publish it.
+	check(ctx context.Context, key, contentType string, data []byte) (reason string, err error)
+}
+
+func quarantineKey(key string) string {
+	return quarantinePrefix + key
+}
+
+func isQuarantineKey(key string) bool {
+	return strings.HasPrefix(key, quarantinePrefix)
+}
+
+// newModerator builds the moderator for MODERATION ("rekognition" or "webhook") and
+// CAT_DETECTION ("rekognition"), chained when both are set. It returns nil when neither is.
+func newModerator(ctx context.Context) (moderator, error) {
+	var chain moderatorChain
+	var rek *rekognitionClient
+	rekognition := func() (*rekognitionClient, error) {
+		if rek != nil {
+			return rek, nil
+		}
+		var err error
+		rek, err = newRekognitionClient(ctx)
+		return rek, err
+	}
+	switch name := os.Getenv("MODERATION"); name {
+	case "":
+	case "rekognition":
+		client, err := rekognition()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, &rekognitionModerator{client: client, minConfidence: float64(envInt("REKOGNITION_MIN_CONFIDENCE", 80))})
+	case "webhook":
+		u := os.Getenv("MODERATION_WEBHOOK_URL")
+		if u == "" {
+			return nil, fmt.Errorf("MODERATION_WEBHOOK_URL must be set")
+		}
+		chain = append(chain, &webhookModerator{url: u, secret: []byte(os.Getenv("MODERATION_WEBHOOK_SECRET"))})
+	default:
+		return nil, fmt.Errorf("unknown moderator %q (want rekognition or webhook)", name)
+	}
+	switch name := os.Getenv("CAT_DETECTION"); name {
+	case "":
+	case "rekognition":
+		client, err := rekognition()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, &catDetector{client: client, minConfidence: float64(envInt("CAT_MIN_CONFIDENCE", 70))})
+	default:
+		return nil, fmt.Errorf("unknown cat detector %q (want rekognition)", name)
+	}
+	switch len(chain) {
+	case 0:
+		return nil, nil
+	case 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// moderatorChain runs moderators in order; the first to object decides.
+type moderatorChain []moderator
+
+func (c moderatorChain) check(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	for _, m := range c {
+		if reason, err := m.check(ctx, key, contentType, data); reason != "" || err != nil {
+			return reason, err
+		}
+	}
+	return "", nil
+}
+
+// moderateUpload runs the moderator over an image before it's published, writing it to
+// quarantine when it's rejected. A moderator error quarantines too, so nothing goes live
+// unchecked. body is what would be stored at key, and is rewound; videos aren't checked.
+// Nothing is done to key itself: uploads are moderated before they're written. err means the
+// quarantine copy couldn't be written, so the upload must fail rather than be reported held.
+func (s *server) moderateUpload(ctx context.Context, key, contentType string, body io.ReadSeeker, meta map[string]string) (quarantined bool, err error) {
+	if s.moderator == nil || mediaKind(contentType) != "image" {
+		return false, nil
+	}
+	data, err := io.ReadAll(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		log.Printf("moderation read: key=%s err=%v", key, errors.Join(err, serr))
+		data = nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, moderationTimeout)
+	defer cancel()
+	reason, err := "", errors.New("could not read upload")
+	if data != nil {
+		reason, err = s.moderator.check(ctx, key, contentType, data)
+	}
+	if err != nil {
+		log.Printf("moderation: key=%s err=%v", key, err)
+		reason = "moderation check failed"
+	}
+	if reason == "" {
+		return false, nil
+	}
+	log.Printf("upload quarantined: key=%s reason=%s", key, reason)
+	qmeta := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		qmeta[k] = v
+	}
+	// Metadata travels as HTTP headers, so the reason is cut down to ASCII.
+	qmeta[moderationReasonMetaName] = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, reason)
+	_, err = s.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(quarantineKey(key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+		ACL:         types.ObjectCannedACLPrivate,
+		Metadata:    qmeta,
+	})
+	if err != nil {
+		return false, s.r2Error("could not quarantine upload", err)
+	}
+	return true, nil
+}
+
+// writeQuarantined answers an upload moderation held back. The upload itself worked, so it's
+// a 202 rather than an error.
+func writeQuarantined(w http.ResponseWriter, key string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"key": key, "status": "quarantined"})
+}
+
+// webhookModerator POSTs each image to a URL that decides. The request body is the image
+// itself, with the key in X-Photo-Key and, when a secret is set, an HMAC-SHA256 of the body
+// in X-Signature (hex). The response is JSON: {"allow": bool, "reason": "..."}.
+type webhookModerator struct {
+	url    string
+	secret []byte
+}
+
+func (m *webhookModerator) check(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Photo-Key", key)
+	if len(m.secret) > 0 {
+		mac := hmac.New(sha256.New, m.secret)
+		mac.Write(data)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("moderation webhook: %s", resp.Status)
+	}
+	var out struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out); err != nil {
+		return "", fmt.Errorf("moderation webhook: %w", err)
+	}
+	if out.Allow {
+		return "", nil
+	}
+	if out.Reason == "" {
+		out.Reason = "rejected by moderation webhook"
+	}
+	return out.Reason, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// maxUploadFormFields caps the non-file fields of a multipart upload, all names and values
+// together.
+const maxUploadFormFields = 64 << 10
+
+// formFile is a file part of a multipart upload, read into memory.
+type formFile struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// uploadForm is a multipart /upload body: its fields and the image and poster files.
+type uploadForm struct {
+	values url.Values
+	image  *formFile
+	poster *formFile
+}
+
+// readUploadForm reads a multipart upload part by part. Unlike ParseMultipartForm it never
+// spills files to temp files: the image (up to the video limit) and poster (up to the image
+// limit) are held in memory, since every later step reads them again, and other file parts
+// are skipped. Exceeding a limit is ErrTooLarge.
+func (s *server) readUploadForm(r *http.Request) (*uploadForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, newError(ErrValidation, "expected a multipart/form-data body")
+	}
+	form := &uploadForm{values: make(url.Values)}
+	fieldBytes := 0
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, multipartError(err)
+		}
+		name := part.FormName()
+		if part.FileName() == "" {
+			v, err := io.ReadAll(io.LimitReader(part, int64(maxUploadFormFields-fieldBytes+1)))
+			if err != nil {
+				return nil, multipartError(err)
+			}
+			fieldBytes += len(name) + len(v)
+			if fieldBytes > maxUploadFormFields {
+				return nil, newError(ErrTooLarge, "form fields too large")
+			}
+			form.values.Add(name, string(v))
+			continue
+		}
+		var dst **formFile
+		limit := s.maxUploadBytes
+		switch name {
+		case "image":
+			dst, limit = &form.image, max(s.maxUploadBytes, s.maxVideoUploadBytes)
+		case "poster":
+			dst = &form.poster
+		default:
+			continue
+		}
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(part, limit+1))
+		if err != nil {
+			return nil, multipartError(err)
+		}
+		if n > limit {
+			return nil, errUploadTooLarge
+		}
+		*dst = &formFile{filename: part.FileName(), contentType: part.Header.Get("Content-Type"), data: buf.Bytes()}
+	}
+	return form, nil
+}
+
+// value returns a form field, falling back to the query string as r.FormValue would.
+func (f *uploadForm) value(r *http.Request, name string) string {
+	if vs := f.values[name]; len(vs) > 0 {
+		return vs[0]
+	}
+	return r.URL.Query().Get(name)
+}
+
+// multipartError maps a failed read of an upload body: past limitUploadBody it's a 413,
+// anything else a malformed body.
+func multipartError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errUploadTooLarge
+	}
+	return newError(ErrValidation, "malformed multipart body")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minPartSize is the smallest part S3 and R2 accept, bar the last.
+const minPartSize = 5 << 20
+
+// putUpload writes an upload of size bytes. Up to MULTIPART_THRESHOLD_BYTES it's one
+// PutObject; larger files, big videos mostly, go up as a multipart upload of
+// MULTIPART_PART_SIZE_BYTES parts, MULTIPART_CONCURRENCY at a time, which is aborted if any
+// part fails. It returns the new version's ID when the bucket keeps versions.
+func (s *server) putUpload(ctx context.Context, in *s3.PutObjectInput, size int64) (versionID string, err error) {
+	if size <= s.multipartThreshold {
+		out, err := s.s3Client.PutObject(ctx, in)
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(out.VersionId), nil
+	}
+	created, err := s.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             in.Bucket,
+		Key:                in.Key,
+		ContentType:        in.ContentType,
+		CacheControl:       in.CacheControl,
+		ContentDisposition: in.ContentDisposition,
+		ACL:                in.ACL,
+		Metadata:           in.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	parts, err := s.sendParts(ctx, in, created.UploadId)
+	if err == nil {
+		var out *s3.CompleteMultipartUploadOutput
+		out, err = s.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          in.Bucket,
+			Key:             in.Key,
+			UploadId:        created.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+			IfNoneMatch:     in.IfNoneMatch,
+		})
+		if err == nil {
+			return aws.ToString(out.VersionId), nil
+		}
+	}
+	// A fresh context: the request's may be what failed.
+	if _, aerr := s.s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   in.Bucket,
+		Key:      in.Key,
+		UploadId: created.UploadId,
+	}); aerr != nil {
+		log.Printf("multipart upload abort: key=%s err=%v", aws.ToString(in.Key), aerr)
+	}
+	return "", err
+}
+
+// sendParts reads in.Body a part at a time and uploads the parts concurrently, holding at
+// most multipartConcurrency parts in memory. It stops at the first failure.
+func (s *server) sendParts(ctx context.Context, in *s3.PutObjectInput, uploadID *string) ([]types.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+	sem := make(chan struct{}, s.multipartConcurrency)
+	for n := int32(1); ctx.Err() == nil; n++ {
+		buf := make([]byte, s.multipartPartSize)
+		read, err := io.ReadFull(in.Body, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			fail(err)
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(n int32, data []byte) {
+			defer func() { <-sem; wg.Done() }()
+			out, err := s.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     in.Bucket,
+				Key:        in.Key,
+				UploadId:   uploadID,
+				PartNumber: aws.Int32(n),
+				Body:       bytes.NewReader(data),
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(n)})
+			mu.Unlock()
+		}(n, buf[:read])
+		if read < len(buf) {
+			break
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(parts, func(a, b types.CompletedPart) int {
+		return int(aws.ToInt32(a.PartNumber) - aws.ToInt32(b.PartNumber))
+	})
+	return parts, nil
+}
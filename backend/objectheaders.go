@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Content-Disposition types for CONTENT_DISPOSITION; dispositionNone leaves it unset.
+const (
+	dispositionNone       = ""
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// parseContentDisposition validates a CONTENT_DISPOSITION value.
+func parseContentDisposition(v string) (string, error) {
+	switch v {
+	case dispositionNone, dispositionInline, dispositionAttachment:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown disposition %q (want inline or attachment)", v)
+}
+
+// cacheControl is the Cache-Control stored with uploads and their derived images
+// (OBJECT_CACHE_CONTROL), or nil to leave it to the bucket or CDN.
+func (s *server) cacheControl() *string {
+	if s.objectCacheControl == "" {
+		return nil
+	}
+	return aws.String(s.objectCacheControl)
+}
+
+// contentDisposition is the Content-Disposition stored with the upload at key, naming the
+// download after the file as sent, or after the key when there's no name. It's nil when
+// CONTENT_DISPOSITION is unset.
+func (s *server) contentDisposition(filename, key string) *string {
+	if s.objectDisposition == dispositionNone {
+		return nil
+	}
+	name := filepath.Base(filename)
+	if filename == "" || name == "." || name == "/" {
+		name = path.Base(key)
+	}
+	// Non-ASCII names are encoded as filename*; this only fails on an invalid type.
+	if v := mime.FormatMediaType(s.objectDisposition, map[string]string{"filename": name}); v != "" {
+		return aws.String(v)
+	}
+	return aws.String(s.objectDisposition)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// oembedProvider is the provider_name in /oembed responses.
+const oembedProvider = "Namu & Rocky"
+
+// handleOEmbed answers oEmbed (https://oembed.com) requests for photo URLs from /feed, so
+// links pasted into chat apps unfurl as the image. Only JSON is supported; maxwidth and
+// maxheight scale the reported size, keeping the aspect ratio. The title is the photo's
+// caption (or caption metadata, meta_caption at upload) when it has one.
+func (s *server) handleOEmbed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if f := q.Get("format"); f != "" && f != "json" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	u := stripToken(q.Get("url"))
+	if u == "" {
+		handleError(w, newError(ErrValidation, "url required"))
+		return
+	}
+	key := s.urlKey(u)
+	s.feedByKeyMu.RLock()
+	u, ok := s.feedByKey[key]
+	st := s.feedStat[key]
+	title := s.detailsFor(key).caption
+	if title == "" {
+		title = s.feedMeta[key]["caption"]
+	}
+	kind := mediaKind(s.contentType(key))
+	s.feedByKeyMu.RUnlock()
+	if !ok {
+		handleError(w, newError(ErrNotFound, "unknown photo url"))
+		return
+	}
+	if title == "" {
+		title = oembedProvider
+	}
+
+	resp := map[string]interface{}{
+		"version":       "1.0",
+		"title":         title,
+		"provider_name": oembedProvider,
+		"provider_url":  siteURL(r),
+	}
+	if thumb := s.thumbURLs([]string{u})[0]; thumb != "" {
+		resp["thumbnail_url"] = thumb
+	}
+	// The photo type requires a size, so anything we can't size (or a video) is a plain link.
+	if kind != "image" || st.width <= 0 || st.height <= 0 {
+		resp["type"] = "link"
+	} else {
+		width, height := fitWithin(st.width, st.height, oembedBound(q.Get("maxwidth")), oembedBound(q.Get("maxheight")))
+		resp["type"] = "photo"
+		resp["url"] = s.signFeedURLs([]string{u})[0]
+		resp["width"] = width
+		resp["height"] = height
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// oembedBound parses a maxwidth or maxheight param; anything missing or invalid is no bound.
+func oembedBound(v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// fitWithin scales w×h down to fit maxW×maxH (0 meaning unbounded), keeping the aspect ratio.
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if maxW > 0 && w > maxW {
+		w, h = maxW, max(h*maxW/w, 1)
+	}
+	if maxH > 0 && h > maxH {
+		w, h = max(w*maxH/h, 1), maxH
+	}
+	return w, h
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Feed ordering modes for the order query param. Random is the default rotation; newest and
+// oldest use the LastModified time captured at listing (or upload) time; taken_at is
+// chronological by EXIF capture time, falling back to LastModified.
+const (
+	orderRandom  = "random"
+	orderNewest  = "newest"
+	orderOldest  = "oldest"
+	orderTakenAt = "taken_at"
+)
+
+// parseFeedOrder reads the order param, defaulting to random.
+func parseFeedOrder(q url.Values) (string, error) {
+	switch o := q.Get("order"); o {
+	case "":
+		return orderRandom, nil
+	case orderRandom, orderNewest, orderOldest, orderTakenAt:
+		return o, nil
+	default:
+		return "", newError(ErrValidation, "order must be random, newest, oldest or taken_at")
+	}
+}
+
+// parseFeedSeed reads the seed param, which only applies to random order.
+func parseFeedSeed(q url.Values, order string) (string, error) {
+	seed := q.Get("seed")
+	if seed != "" && order != orderRandom {
+		return "", newError(ErrValidation, "seed only applies to order=random")
+	}
+	return seed, nil
+}
+
+// seededPermutation shuffles pool with a rand source seeded from clientKey and seed. The pool
+// is sorted first, so the same key, seed and pool always give the same sequence.
+func seededPermutation(pool []string, clientKey, seed string) []string {
+	h := fnv.New64a()
+	h.Write([]byte(clientKey))
+	h.Write([]byte{0})
+	h.Write([]byte(seed))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+	perm := slices.Clone(pool)
+	slices.Sort(perm)
+	rng.Shuffle(len(perm), func(i, j int) { perm[i], perm[j] = perm[j], perm[i] })
+	return perm
+}
+
+// orderedURL is a feed URL with the fields it sorts on. modified is the capture time
+// (see objectStat.takenOrModified) for order=taken_at.
+type orderedURL struct {
+	url      string
+	key      string
+	modified time.Time
+}
+
+// orderedLess orders by modified time for newest/oldest, falling back to key, and by key
+// alone for any other mode.
+func orderedLess(order string, a, b orderedURL) bool {
+	if !a.modified.Equal(b.modified) {
+		switch order {
+		case orderNewest:
+			return a.modified.After(b.modified)
+		case orderOldest, orderTakenAt:
+			return a.modified.Before(b.modified)
+		}
+	}
+	return a.key < b.key
+}
+
+// sortFeedURLs returns urls sorted for order (see orderedLess).
+func (s *server) sortFeedURLs(urls []string, order string) []orderedURL {
+	entries := make([]orderedURL, len(urls))
+	s.feedByKeyMu.RLock()
+	for i, u := range urls {
+		k := s.urlKey(u)
+		entries[i] = orderedURL{url: u, key: k, modified: s.feedStat[k].modified}
+		if order == orderTakenAt {
+			entries[i].modified = s.feedStat[k].takenOrModified()
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return orderedLess(order, entries[i], entries[j]) })
+	return entries
+}
+
+// feedChoice says how chooseFeedURLs picks: by order, and for random order optionally
+// following a seeded permutation (see seededPermutation) or weighting by serve counts (see
+// weightedSample).
+type feedChoice struct {
+	order  string
+	seeded []string
+	serves map[string]int64
+}
+
+// chooseFeedURLs takes count URLs from available: a random sample, or the first count in
+// order. A seeded permutation replaces the random sample with the first count available URLs
+// in its sequence. Must be called with requestSeenMu held, since it uses rng.
+func (s *server) chooseFeedURLs(available []string, count int, c feedChoice) []string {
+	out := make([]string, count)
+	if c.seeded != nil {
+		avail := make(map[string]struct{}, len(available))
+		for _, u := range available {
+			avail[u] = struct{}{}
+		}
+		out = out[:0]
+		for _, u := range c.seeded {
+			if len(out) == count {
+				break
+			}
+			if _, ok := avail[u]; ok {
+				out = append(out, u)
+			}
+		}
+		return out
+	}
+	if c.order == orderRandom && c.serves != nil {
+		return weightedSample(s.rng, available, c.serves, count)
+	}
+	if c.order == orderRandom {
+		for i, j := range s.rng.Perm(len(available))[:count] {
+			out[i] = available[j]
+		}
+		return out
+	}
+	for i, e := range s.sortFeedURLs(available, c.order)[:count] {
+		out[i] = e.url
+	}
+	return out
+}
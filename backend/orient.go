@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// orientJPEGQuality is used when a photo is re-encoded to apply its orientation; high, since
+// it's the stored original.
+const orientJPEGQuality = 92
+
+// orientUpload applies a JPEG upload's EXIF orientation, returning the body to store and its
+// size. Other formats are stored as is.
+func orientUpload(body io.ReadSeeker, size int64, contentType string) (io.ReadSeeker, int64, error) {
+	if contentType != "image/jpeg" {
+		return body, size, nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if oriented, ok := applyOrientation(data); ok {
+		data = oriented
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// applyOrientation rotates or flips a JPEG's pixels as its EXIF Orientation says and
+// re-encodes it, so it displays upright whether or not the browser honours the tag. The
+// result carries no EXIF at all, so anything wanted from it (the capture time) must be read
+// first. ok is false when the photo is already upright or can't be decoded.
+func applyOrientation(data []byte) (out []byte, ok bool) {
+	tiff, err := jpegExif(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	o := exifOrientation(tiff)
+	if o < 2 || o > 8 {
+		return nil, false
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(src, o), &jpeg.Options{Quality: orientJPEGQuality}); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// orient returns src transformed by EXIF orientation o (2-8): mirrored, rotated, or both.
+// Orientations 5-8 swap width and height.
+func orient(src image.Image, o int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handlePair returns one random photo tagged namu and one tagged rocky for the side-by-side
+// game. Photos tagged "both" are left out since they'd show both cats on one side. Accepts
+// fields like /feed; nothing is marked seen.
+func (s *server) handlePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	fields, err := parseFeedFields(r.URL.Query())
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	byCat := map[string][]string{}
+	for _, e := range s.feedList() {
+		if c := e.meta[catMetaName]; c == "namu" || c == "rocky" {
+			byCat[c] = append(byCat[c], e.url)
+		}
+	}
+	for _, c := range []string{"namu", "rocky"} {
+		if len(byCat[c]) == 0 {
+			handleError(w, newError(ErrNotFound, "no photos tagged "+c))
+			return
+		}
+	}
+	s.requestSeenMu.Lock()
+	urls := []string{
+		byCat["namu"][s.rng.Intn(len(byCat["namu"]))],
+		byCat["rocky"][s.rng.Intn(len(byCat["rocky"]))],
+	}
+	s.requestSeenMu.Unlock()
+	items := s.feedResponse(urls, fields)["items"].([]map[string]interface{})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"namu": items[0], "rocky": items[1]})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// createPendingTable creates the table of uploads waiting for approval (REQUIRE_APPROVAL).
+// Pending objects are stored privately (see uploadACL); their row is what keeps them out of
+// the feed until POST /admin/photos/{key}/approve.
+func createPendingTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS pending_photos (
+			photo_key TEXT PRIMARY KEY,
+			uploaded_at TIMESTAMPTZ DEFAULT NOW()
+		);
+	`)
+	return err
+}
+
+// pendingKeys returns every key waiting for approval. Like hiddenKeys it's read on each
+// listing, so an approval on one instance holds on all of them.
+func (s *server) pendingKeys(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT photo_key FROM pending_photos`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pending := make(map[string]bool)
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		pending[k] = true
+	}
+	return pending, rows.Err()
+}
+
+// uploadACL is the ACL uploads and their derived images are written with. With
+// REQUIRE_APPROVAL every upload starts out pending, so they're private until approvePending
+// makes them public.
+func (s *server) uploadACL() types.ObjectCannedACL {
+	if s.requireApproval {
+		return types.ObjectCannedACLPrivate
+	}
+	return types.ObjectCannedACLPublicRead
+}
+
+// makePublic sets objKey in the primary bucket public-read.
+func (s *server) makePublic(ctx context.Context, objKey string) error {
+	_, err := s.s3Client.PutObjectAcl(ctx, &s3.PutObjectAclInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(objKey),
+		ACL:    types.ObjectCannedACLPublicRead,
+	})
+	return err
+}
+
+// holdForApproval queues a stored upload for review. A refresh may have listed the object
+// between its write and now, so it's also taken out of the index.
+func (s *server) holdForApproval(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO pending_photos (photo_key) VALUES ($1)
+		ON CONFLICT (photo_key) DO UPDATE SET uploaded_at = NOW()
+	`, key); err != nil {
+		return err
+	}
+	s.feedByKeyMu.RLock()
+	_, listed := s.feedByKey[key]
+	s.feedByKeyMu.RUnlock()
+	if listed {
+		s.removeFromFeed([]string{key})
+	}
+	log.Printf("upload pending approval: key=%s", key)
+	return nil
+}
+
+// approvePending publishes a pending upload. The object is made public first, so a failure
+// leaves it pending to approve again. The feed is then refreshed to index it along with its
+// derived images, which are made public in turn, and its metadata is read back, which a
+// listing doesn't carry.
+func (s *server) approvePending(ctx context.Context, key string) error {
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pending_photos WHERE photo_key = $1`, key).Scan(&n); err != nil {
+		return wrapError(ErrInternal, "approve failed", err)
+	}
+	if n == 0 {
+		return newError(ErrNotFound, "photo is not pending")
+	}
+	if err := s.makePublic(ctx, key); err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return newError(ErrNotFound, "photo is no longer in the bucket")
+		}
+		return s.r2Error("approve failed", err)
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pending_photos WHERE photo_key = $1`, key)
+	if err != nil {
+		return wrapError(ErrInternal, "approve failed", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return newError(ErrNotFound, "photo is not pending")
+	}
+	if err := s.setPhotoStatus(ctx, key, photoPublished); err != nil {
+		log.Printf("approve status: key=%s err=%v", key, err)
+	}
+	if _, _, err := s.refreshFeed(ctx); err != nil {
+		return s.r2Error("approve failed", err)
+	}
+	s.feedByKeyMu.RLock()
+	_, listed := s.feedByKey[key]
+	s.feedByKeyMu.RUnlock()
+	if !listed {
+		return newError(ErrNotFound, "photo is no longer in the bucket")
+	}
+	head, err := s.headMetadata(ctx, key)
+	if err != nil {
+		log.Printf("approve metadata: key=%s err=%v", key, err)
+	}
+	s.feedByKeyMu.Lock()
+	st := s.feedStat[key]
+	if err == nil {
+		st.contentType, st.width, st.height, st.takenAt, st.animated = head.contentType, head.width, head.height, head.takenAt, head.animated
+		s.feedStat[key] = st
+		if len(head.meta) > 0 {
+			s.feedMeta[key] = head.meta
+		}
+		s.invalidateFeedCache()
+	}
+	meta := s.feedMeta[key]
+	s.feedByKeyMu.Unlock()
+	derived := make([]string, 0, 1+len(st.renditions)+len(st.formats))
+	if st.thumb {
+		derived = append(derived, thumbKey(key))
+	}
+	for _, size := range st.renditions {
+		derived = append(derived, renditionKey(key, size))
+	}
+	for _, f := range st.formats {
+		derived = append(derived, formatKey(key, f))
+	}
+	for _, k := range derived {
+		if err := s.makePublic(ctx, k); err != nil {
+			log.Printf("approve derived image: key=%s err=%v", k, err)
+		}
+	}
+	s.shareFeedObject(ctx, key, newSnapshotObject(st, meta))
+	s.publishPhotoAdded(key)
+	return nil
+}
+
+// rejectPending deletes a pending upload along with its derived images and rows.
+func (s *server) rejectPending(ctx context.Context, key string) error {
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pending_photos WHERE photo_key = $1`, key).Scan(&n); err != nil {
+		return wrapError(ErrInternal, "reject failed", err)
+	}
+	if n == 0 {
+		return newError(ErrNotFound, "photo is not pending")
+	}
+	if results, _ := s.deletePhotos(ctx, []string{key}); !results[0].Deleted {
+		return newError(ErrUpstream, "reject failed: "+results[0].Error)
+	}
+	return nil
+}
+
+// pendingPhoto is one entry in the GET /admin/pending listing.
+type pendingPhoto struct {
+	Key        string    `json:"key"`
+	URL        string    `json:"url"`
+	Caption    string    `json:"caption,omitempty"`
+	Cat        string    `json:"cat,omitempty"`
+	UploadedBy string    `json:"uploaded_by,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// handlePending serves GET /admin/pending: uploads waiting for approval, oldest first, with
+// a presigned URL to review each by, since they're private until approved. POST /admin/photos/{key}/approve publishes one and
+// /admin/photos/{key}/reject deletes it.
+func (s *server) handlePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT photo_key, uploaded_at FROM pending_photos
+		ORDER BY uploaded_at, photo_key
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "pending list failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	defer rows.Close()
+	pending := []pendingPhoto{}
+	for rows.Next() {
+		var p pendingPhoto
+		if err := rows.Scan(&p.Key, &p.UploadedAt); err != nil {
+			handleError(w, wrapError(ErrInternal, "pending list failed", fmt.Errorf("scan: %w", err)))
+			return
+		}
+		d := s.detailsFor(p.Key)
+		p.URL = s.reviewURL(r.Context(), p.Key)
+		p.Caption, p.Cat, p.UploadedBy = d.caption, d.cat, d.uploadedBy
+		pending = append(pending, p)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, wrapError(ErrInternal, "pending list failed", fmt.Errorf("rows: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"pending": pending})
+}
+
+// reviewURL presigns a GET for a pending upload, valid for URL_SIGNING_TTL_SEC. If that
+// fails the plain URL is returned, which won't load until the upload is approved.
+func (s *server) reviewURL(ctx context.Context, key string) string {
+	req, err := s3.NewPresignClient(s.s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(currentTunables().URLSigningTTL))
+	if err != nil {
+		log.Printf("pending presign: key=%s err=%v", key, err)
+		return s.objectURL(key)
+	}
+	return req.URL
+}
+
+// writePending answers an upload that's stored but waiting for approval. Like
+// writeQuarantined it's a 202: resp is the usual upload response.
+func writePending(w http.ResponseWriter, resp map[string]interface{}) {
+	resp["status"] = "pending"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/lib/pq"
+)
+
+const (
+	maxCaptionLen    = 500
+	maxUploadedByLen = 64
+)
+
+// photoDetails are the descriptive fields given at upload. They're kept in Postgres rather
+// than object metadata, which only takes ASCII.
+type photoDetails struct {
+	caption    string
+	cat        string
+	uploadedBy string
+}
+
+// Photo statuses in the photos table: pending photos are waiting for approval (see
+// holdForApproval), quarantined ones were held back by moderation (see handleQuarantine) and
+// missing ones have left the bucket behind our back.
+const (
+	photoPublished   = "published"
+	photoPending     = "pending"
+	photoQuarantined = "quarantined"
+	photoMissing     = "missing"
+)
+
+// photoRecord is a photo's row in the photos table: its upload details and what's known of
+// the stored object. The table is the source of truth for what a bucket listing lacks (type,
+// dimensions, capture time); see applyPhotoRecords.
+type photoRecord struct {
+	photoDetails
+	url           string
+	contentType   string
+	size          int64
+	width, height int
+	takenAt       time.Time
+	animated      bool
+	status        string
+}
+
+// createPhotosTable creates the table of photo records, adding the object columns to tables
+// made when it only held upload details.
+func createPhotosTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS photos (
+			photo_key TEXT PRIMARY KEY,
+			caption TEXT NOT NULL DEFAULT '',
+			cat TEXT NOT NULL DEFAULT '',
+			uploaded_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);
+		ALTER TABLE photos
+			ADD COLUMN IF NOT EXISTS url TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS width INT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS height INT NOT NULL DEFAULT 0,
+			ADD COLUMN IF NOT EXISTS taken_at TIMESTAMPTZ,
+			ADD COLUMN IF NOT EXISTS animated BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'published';
+	`)
+	return err
+}
+
+// parsePhotoDetails validates the caption, cat and uploaded_by upload fields, all optional.
+func parsePhotoDetails(caption, cat, uploadedBy string) (photoDetails, error) {
+	var d photoDetails
+	var err error
+	if d.cat, err = parseCat(cat); err != nil {
+		return d, err
+	}
+	d.caption = strings.TrimSpace(caption)
+	d.uploadedBy = strings.TrimSpace(uploadedBy)
+	if !utf8.ValidString(d.caption) || utf8.RuneCountInString(d.caption) > maxCaptionLen {
+		return d, newError(ErrValidation, "caption must be at most 500 characters")
+	}
+	if !utf8.ValidString(d.uploadedBy) || utf8.RuneCountInString(d.uploadedBy) > maxUploadedByLen {
+		return d, newError(ErrValidation, "uploaded_by must be at most 64 characters")
+	}
+	return d, nil
+}
+
+// loadPhotos refreshes the in-memory photo records from Postgres. Like loadPinned it runs at
+// startup and on every feed refresh; writes between refreshes update their own records
+// through updatePhotoRecords.
+func (s *server) loadPhotos(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT photo_key, caption, cat, uploaded_by, url, content_type, size, width, height, taken_at, animated, status
+		FROM photos
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	records := make(map[string]photoRecord)
+	for rows.Next() {
+		var k string
+		var r photoRecord
+		var takenAt sql.NullTime
+		if err := rows.Scan(&k, &r.caption, &r.cat, &r.uploadedBy, &r.url, &r.contentType, &r.size, &r.width, &r.height, &takenAt, &r.animated, &r.status); err != nil {
+			return err
+		}
+		r.takenAt = takenAt.Time
+		records[k] = r
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.photos.Store(&records)
+	return nil
+}
+
+func (s *server) reloadPhotos(ctx context.Context) {
+	if err := s.loadPhotos(ctx); err != nil {
+		log.Printf("photo records reload: %v", err)
+	}
+}
+
+// updatePhotoRecords applies change to a copy of the in-memory photo records and stores the
+// copy, so readers holding the old map never see it change. It's retried if another write or
+// a reload stored a map in the meantime.
+func (s *server) updatePhotoRecords(change func(records map[string]photoRecord)) {
+	for {
+		old := s.photos.Load()
+		records := make(map[string]photoRecord)
+		if old != nil {
+			for k, r := range *old {
+				records[k] = r
+			}
+		}
+		change(records)
+		if s.photos.CompareAndSwap(old, &records) {
+			return
+		}
+	}
+}
+
+// recordFor returns key's photo record and whether it has one.
+func (s *server) recordFor(key string) (photoRecord, bool) {
+	if p := s.photos.Load(); p != nil {
+		r, ok := (*p)[key]
+		return r, ok
+	}
+	return photoRecord{}, false
+}
+
+// detailsFor returns key's upload details; the zero value when it has none.
+func (s *server) detailsFor(key string) photoDetails {
+	r, _ := s.recordFor(key)
+	return r.photoDetails
+}
+
+// recordPhoto stores an upload's record, replacing that of an earlier upload to the same
+// key.
+func (s *server) recordPhoto(ctx context.Context, key string, st objectStat, d photoDetails, status string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO photos (photo_key, caption, cat, uploaded_by, url, content_type, size, width, height, taken_at, animated, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (photo_key) DO UPDATE
+		SET caption = EXCLUDED.caption, cat = EXCLUDED.cat, uploaded_by = EXCLUDED.uploaded_by,
+			url = EXCLUDED.url, content_type = EXCLUDED.content_type, size = EXCLUDED.size,
+			width = EXCLUDED.width, height = EXCLUDED.height, taken_at = EXCLUDED.taken_at,
+			animated = EXCLUDED.animated, status = EXCLUDED.status, created_at = NOW()
+	`, key, d.caption, d.cat, d.uploadedBy, s.bucketURL(st.bucket, key), st.contentType, st.size, st.width, st.height,
+		sql.NullTime{Time: st.takenAt, Valid: !st.takenAt.IsZero()}, st.animated, status)
+	if err != nil {
+		return err
+	}
+	rec := photoRecord{
+		photoDetails: d,
+		url:          s.bucketURL(st.bucket, key),
+		contentType:  st.contentType,
+		size:         st.size,
+		width:        st.width,
+		height:       st.height,
+		takenAt:      st.takenAt,
+		animated:     st.animated,
+		status:       status,
+	}
+	s.updatePhotoRecords(func(records map[string]photoRecord) { records[key] = rec })
+	return nil
+}
+
+// setPhotoStatus changes key's status in the photos table and in its in-memory record.
+func (s *server) setPhotoStatus(ctx context.Context, key, status string) error {
+	if _, err := s.db.ExecContext(ctx, `UPDATE photos SET status = $2 WHERE photo_key = $1`, key, status); err != nil {
+		return err
+	}
+	s.updatePhotoRecords(func(records map[string]photoRecord) { setStatus(records, key, status) })
+	return nil
+}
+
+// setStatus sets the status of key's record in records, if it has one.
+func setStatus(records map[string]photoRecord, key, status string) {
+	if r, ok := records[key]; ok {
+		r.status = status
+		records[key] = r
+	}
+}
+
+// applyPhotoRecords fills in the content type, dimensions, capture time and animation of
+// listed objects from their photo records, since a listing only has size and time.
+func (s *server) applyPhotoRecords(stats map[string]objectStat) {
+	p := s.photos.Load()
+	if p == nil {
+		return
+	}
+	for k, st := range stats {
+		r, ok := (*p)[k]
+		if !ok || r.contentType == "" {
+			continue
+		}
+		st.contentType, st.width, st.height, st.takenAt, st.animated = r.contentType, r.width, r.height, r.takenAt, r.animated
+		stats[k] = st
+	}
+}
+
+// backfillPhotos writes a record for each indexed photo in the primary bucket that lacks
+// one, or whose record predates the object columns. Type, dimensions and capture time come
+// from the object's metadata, HEADing it when the index doesn't have them. It runs once at
+// startup, in the background.
+func (s *server) backfillPhotos(ctx context.Context) (int, error) {
+	type pending struct {
+		key string
+		st  objectStat
+	}
+	var todo []pending
+	s.feedByKeyMu.RLock()
+	for k, st := range s.feedStat {
+		if st.bucket != "" {
+			continue
+		}
+		if r, ok := s.recordFor(k); ok && r.contentType != "" {
+			continue
+		}
+		todo = append(todo, pending{k, st})
+	}
+	s.feedByKeyMu.RUnlock()
+	if len(todo) == 0 {
+		return 0, nil
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for i := range todo {
+		if todo[i].st.contentType != "" {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *pending) {
+			defer func() { <-sem; wg.Done() }()
+			res, err := s.headMetadata(ctx, p.key)
+			if err != nil {
+				log.Printf("photo backfill head: key=%s err=%v", p.key, err)
+				p.st.contentType = guessContentType(p.key)
+				return
+			}
+			p.st.contentType, p.st.width, p.st.height, p.st.takenAt, p.st.animated = res.contentType, res.width, res.height, res.takenAt, res.animated
+		}(&todo[i])
+	}
+	wg.Wait()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO photos (photo_key, url, content_type, size, width, height, taken_at, animated, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (photo_key) DO UPDATE
+		SET url = EXCLUDED.url, content_type = EXCLUDED.content_type, size = EXCLUDED.size,
+			width = EXCLUDED.width, height = EXCLUDED.height, taken_at = EXCLUDED.taken_at,
+			animated = EXCLUDED.animated
+		WHERE photos.content_type = ''
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, p := range todo {
+		if _, err := stmt.ExecContext(ctx, p.key, s.objectURL(p.key), p.st.contentType, p.st.size, p.st.width, p.st.height,
+			sql.NullTime{Time: p.st.takenAt, Valid: !p.st.takenAt.IsZero()}, p.st.animated, p.st.modified); err != nil {
+			return 0, fmt.Errorf("%s: %w", p.key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(todo), s.loadPhotos(ctx)
+}
+
+// deletePhotos deletes keys from their buckets along with their thumbnails and other derived
+// copies, then drops them from the feed and every table that refers to them. It returns the
+// per-key results and the keys deleted.
+func (s *server) deletePhotos(ctx context.Context, keys []string) (results []deleteResult, deleted []string) {
+	results = s.deleteKeys(ctx, keys)
+	deleted = make([]string, 0, len(results))
+	for _, res := range results {
+		if res.Deleted {
+			deleted = append(deleted, res.Key)
+		}
+	}
+	if len(deleted) == 0 {
+		return results, deleted
+	}
+	// Thumbnails first: their bucket is looked up in the index removeFromFeed clears.
+	s.deleteThumbnails(ctx, deleted)
+	s.removeFromFeed(deleted)
+	if err := s.deletePhotoRows(ctx, deleted); err != nil {
+		log.Printf("photo delete rows: %v", err)
+	}
+	s.reloadPinned(ctx)
+	return results, deleted
+}
+
+// photoTables are the tables with a row per photo, keyed by photo_key.
+var photoTables = []string{"photos", "upload_hashes", "hidden_photos", "pinned_photos", "pending_photos", "photo_votes"}
+
+// deletePhotoRows removes deleted photos from every photo table in one transaction.
+// removeFromFeed clears some of these too, but it also runs for hides, so hidden and pinned
+// rows are only cleared here.
+func (s *server) deletePhotoRows(ctx context.Context, keys []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range photoTables {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE photo_key = ANY($1)`, pq.Array(keys)); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// handlePhoto serves /photos/{key}: DELETE removes the photo (admin only). key may be a
+// photo ID. /photos/{key}/versions lists its versions (see handlePhotoVersions) and
+// /photos/{key}/vote takes votes on it (see handlePhotoVote).
+func (s *server) handlePhoto(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/photos/")
+	if ref, ok := strings.CutSuffix(rest, "/versions"); ok {
+		s.handlePhotoVersions(w, r, s.resolvePhoto(ref))
+		return
+	}
+	if ref, ok := strings.CutSuffix(rest, "/vote"); ok {
+		s.handlePhotoVote(w, r, s.resolvePhoto(ref))
+		return
+	}
+	if r.Method != http.MethodDelete {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	key := s.resolvePhoto(rest)
+	if key == "" || isDerivedKey(key) || isQuarantineKey(key) || isIncomingKey(key) {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	// Hidden photos aren't in the index, so the bucket is asked.
+	_, err := s.s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.keyBucket(key)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			handleError(w, newError(ErrNotFound, "not found"))
+			return
+		}
+		handleError(w, s.r2Error("delete failed", err))
+		return
+	}
+	results, _ := s.deletePhotos(r.Context(), []string{key})
+	if res := results[0]; !res.Deleted {
+		handleError(w, newError(ErrUpstream, "delete failed: "+res.Error))
+		return
+	}
+	log.Printf("photo deleted: key=%s", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// markPhotos moves those of keys with status from to status to, returning the keys it
+// changed, and updates their in-memory records.
+func (s *server) markPhotos(ctx context.Context, keys []string, from, to string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE photos SET status = $3 WHERE photo_key = ANY($1) AND status = $2
+		RETURNING photo_key
+	`, pq.Array(keys), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changed := []string{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		changed = append(changed, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(changed) > 0 {
+		s.updatePhotoRecords(func(records map[string]photoRecord) {
+			for _, k := range changed {
+				setStatus(records, k, to)
+			}
+		})
+	}
+	return changed, nil
+}
+
+// reconcilePhotos brings record statuses in line with the feed index: published photos
+// that aren't indexed are marked missing, and missing ones that are back are published.
+// Hidden photos are out of the index on purpose and left alone.
+func (s *server) reconcilePhotos(ctx context.Context) (missing, restored []string, err error) {
+	hidden, err := s.hiddenKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var gone, back []string
+	if p := s.photos.Load(); p != nil {
+		s.feedByKeyMu.RLock()
+		for k, r := range *p {
+			_, indexed := s.feedByKey[k]
+			switch {
+			case r.status == photoPublished && !indexed && !hidden[k]:
+				gone = append(gone, k)
+			case r.status == photoMissing && indexed:
+				back = append(back, k)
+			}
+		}
+		s.feedByKeyMu.RUnlock()
+	}
+	if missing, err = s.markPhotos(ctx, gone, photoPublished, photoMissing); err != nil {
+		return nil, nil, err
+	}
+	if restored, err = s.markPhotos(ctx, back, photoMissing, photoPublished); err != nil {
+		return nil, nil, err
+	}
+	return missing, restored, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// createPhotoVotesTable creates the table of per-photo votes, one per client key and photo,
+// each a guess at which cat is pictured. Votes follow photo_key, so a photo uploaded twice
+// splits its votes across two keys until POST /admin/merge-photos consolidates them.
+func createPhotoVotesTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS photo_votes (
+			photo_key TEXT NOT NULL,
+			key TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			updated_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (photo_key, key)
+		);
+		ALTER TABLE photo_votes ADD COLUMN IF NOT EXISTS cat TEXT NOT NULL;
+	`)
+	return err
+}
+
+// photoVoteRequest is the JSON body for POST /photos/{key}/vote.
+type photoVoteRequest struct {
+	Key string `json:"key"` // client identifier (who is voting), as for /vote
+	Cat string `json:"cat"` // which cat the voter thinks is pictured: one of cats
+}
+
+// loadPhotoVotes refreshes the in-memory per-photo tallies from Postgres. Like loadPinned it
+// runs at startup and on every feed refresh; a vote only refreshes its own photo's tally,
+// through loadPhotoTally.
+func (s *server) loadPhotoVotes(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT photo_key, cat, COUNT(*) FROM photo_votes GROUP BY photo_key, cat`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tallies := make(map[string]map[string]int64)
+	for rows.Next() {
+		var k, cat string
+		var n int64
+		if err := rows.Scan(&k, &cat, &n); err != nil {
+			return err
+		}
+		if tallies[k] == nil {
+			tallies[k] = make(map[string]int64)
+		}
+		tallies[k][cat] = n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.photoVotes.Store(&tallies)
+	return nil
+}
+
+// reloadPhotoVotes is loadPhotoVotes for background callers, which can only log a failure.
+func (s *server) reloadPhotoVotes(ctx context.Context) {
+	if err := s.loadPhotoVotes(ctx); err != nil {
+		log.Printf("load photo votes: %v", err)
+	}
+}
+
+// loadPhotoTally re-reads key's tally from Postgres into the in-memory tallies, copying the
+// map rather than modifying the one readers may hold.
+func (s *server) loadPhotoTally(ctx context.Context, key string) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT cat, COUNT(*) FROM photo_votes WHERE photo_key = $1 GROUP BY cat`, key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tally := make(map[string]int64)
+	for rows.Next() {
+		var cat string
+		var n int64
+		if err := rows.Scan(&cat, &n); err != nil {
+			return err
+		}
+		tally[cat] = n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Retried if another vote or a full reload swapped the map in the meantime, so neither
+	// update is lost.
+	for {
+		old := s.photoVotes.Load()
+		tallies := make(map[string]map[string]int64)
+		if old != nil {
+			for k, t := range *old {
+				tallies[k] = t
+			}
+		}
+		tallies[key] = tally
+		if s.photoVotes.CompareAndSwap(old, &tallies) {
+			return nil
+		}
+	}
+}
+
+// photoTally returns key's vote counts by cat, with every cat present.
+func (s *server) photoTally(key string) map[string]int64 {
+	tally := make(map[string]int64, len(cats))
+	for _, c := range cats {
+		tally[c] = 0
+	}
+	if p := s.photoVotes.Load(); p != nil {
+		for c, n := range (*p)[key] {
+			tally[c] = n
+		}
+	}
+	return tally
+}
+
+// handlePhotoVote serves POST /photos/{key}/vote: a client's guess at which cat is in the
+// photo. A client has one vote per photo; voting again replaces it. Responds with the
+// photo's updated tally.
+func (s *server) handlePhotoVote(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	var req photoVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON"))
+		return
+	}
+	if req.Key == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return
+	}
+	cat, err := parseCat(req.Cat)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if cat == "" {
+		handleError(w, newError(ErrValidation, "cat required"))
+		return
+	}
+	// Only photos in the feed can be voted on, not hidden or pending ones.
+	s.feedByKeyMu.RLock()
+	_, ok := s.feedByKey[key]
+	s.feedByKeyMu.RUnlock()
+	if !ok {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	if allowed, retry := s.voteIPLimiter.allow(clientIP(r), req.Key); !allowed {
+		log.Printf("photo vote rejected: too many keys from ip=%s key=%s", clientIP(r), req.Key)
+		handleError(w, retryError(ErrRateLimited, "too many votes from this network", retry))
+		return
+	}
+	_, err = s.db.ExecContext(r.Context(),
+		`INSERT INTO photo_votes (photo_key, key, cat) VALUES ($1, $2, $3)
+		 ON CONFLICT (photo_key, key) DO UPDATE SET cat = $3, updated_at = NOW()`,
+		key, req.Key, cat)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "vote failed", fmt.Errorf("insert: %w", err)))
+		return
+	}
+	if err := s.loadPhotoTally(r.Context(), key); err != nil {
+		handleError(w, wrapError(ErrInternal, "vote failed", fmt.Errorf("tally: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "cat_votes": s.photoTally(key)})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// createPinnedTable creates the table of keys pinned to the top of every /feed batch.
+func createPinnedTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS pinned_photos (
+			photo_key TEXT PRIMARY KEY,
+			pinned_at TIMESTAMPTZ DEFAULT NOW()
+		);
+	`)
+	return err
+}
+
+// loadPinned refreshes the in-memory pinned list from Postgres, oldest pin first. It runs
+// at startup, after each pin change and on every feed refresh, so pins made on another
+// instance show up within a refresh interval.
+func (s *server) loadPinned(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT photo_key FROM pinned_photos ORDER BY pinned_at, photo_key`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var pinned []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return err
+		}
+		pinned = append(pinned, k)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.pinned.Store(&pinned)
+	return nil
+}
+
+// setPinned pins or unpins key and reloads the pinned list.
+func (s *server) setPinned(ctx context.Context, key string, pin bool) error {
+	var err error
+	if pin {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO pinned_photos (photo_key) VALUES ($1) ON CONFLICT (photo_key) DO NOTHING`, key)
+	} else {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM pinned_photos WHERE photo_key = $1`, key)
+	}
+	if err != nil {
+		return err
+	}
+	return s.loadPinned(ctx)
+}
+
+// splitPinned separates the pinned URLs in pool, in pin order, from the rest.
+func (s *server) splitPinned(pool []string) (pinned, rest []string) {
+	p := s.pinned.Load()
+	if p == nil || len(*p) == 0 {
+		return nil, pool
+	}
+	inPool := make(map[string]bool, len(pool))
+	for _, u := range pool {
+		inPool[u] = true
+	}
+	isPinned := make(map[string]bool, len(*p))
+	s.feedByKeyMu.RLock()
+	for _, k := range *p {
+		if u, ok := s.feedByKey[k]; ok && inPool[u] {
+			pinned = append(pinned, u)
+			isPinned[u] = true
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+	if len(pinned) == 0 {
+		return nil, pool
+	}
+	rest = make([]string, 0, len(pool)-len(pinned))
+	for _, u := range pool {
+		if !isPinned[u] {
+			rest = append(rest, u)
+		}
+	}
+	return pinned, rest
+}
+
+// reloadPinned is loadPinned for background callers, which can only log a failure.
+func (s *server) reloadPinned(ctx context.Context) {
+	if err := s.loadPinned(ctx); err != nil {
+		log.Printf("pinned reload: %v", err)
+	}
+}
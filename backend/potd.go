@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// potdCache holds the photo of the day once picked, so uploads later in the day don't change
+// it. It's only re-picked when the date rolls over or the photo is deleted.
+type potdCache struct {
+	mu   sync.Mutex
+	date string
+	key  string
+}
+
+// handlePOTD returns one photo per UTC calendar day: the date is hashed to an index into
+// the sorted key set, so instances with the same index agree on the pick without coordinating.
+func (s *server) handlePOTD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	date := time.Now().UTC().Format(time.DateOnly)
+	key, ok := s.photoOfTheDay(date)
+	if !ok {
+		handleError(w, newError(ErrNotFound, "no photos"))
+		return
+	}
+	s.feedByKeyMu.RLock()
+	u := s.feedByKey[key]
+	s.feedByKeyMu.RUnlock()
+	item := s.feedResponse([]string{u}, nil)["items"].([]map[string]interface{})[0]
+	item["date"] = date
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+// photoOfTheDay returns the key picked for date, picking and caching it if needed.
+func (s *server) photoOfTheDay(date string) (string, bool) {
+	s.potd.mu.Lock()
+	defer s.potd.mu.Unlock()
+	s.feedByKeyMu.RLock()
+	defer s.feedByKeyMu.RUnlock()
+	if s.potd.date == date {
+		if _, ok := s.feedByKey[s.potd.key]; ok {
+			return s.potd.key, true
+		}
+	}
+	if len(s.feedByKey) == 0 {
+		return "", false
+	}
+	keys := make([]string, 0, len(s.feedByKey))
+	for k := range s.feedByKey {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	h := fnv.New64a()
+	h.Write([]byte(date))
+	s.potd.date, s.potd.key = date, keys[h.Sum64()%uint64(len(keys))]
+	return s.potd.key, true
+}
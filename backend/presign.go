@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// presignUploadTTL is how long a presigned PUT URL is valid.
+	presignUploadTTL = 15 * time.Minute
+	// presignConfirmGrace is how long after the URL expires the upload can still be confirmed,
+	// for a PUT that started just before expiry.
+	presignConfirmGrace = 15 * time.Minute
+	// incomingPrefix is where presigned uploads land, at incoming/{key}: private, and never
+	// feed items. Confirming one runs it through the upload pipeline to its real key.
+	incomingPrefix = "incoming/"
+)
+
+func incomingKey(key string) string {
+	return incomingPrefix + key
+}
+
+func isIncomingKey(key string) bool {
+	return strings.HasPrefix(key, incomingPrefix)
+}
+
+// uploadIntent is the body of POST /upload/presign and /upload/resumable: a file to be
+// sent separately.
+type uploadIntent struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Cat         string `json:"cat"`         // optional cat tag, as for /upload
+	Caption     string `json:"caption"`     // optional, as for /upload
+	UploadedBy  string `json:"uploaded_by"` // optional, as for /upload
+	Album       string `json:"album"`       // optional album, as for /upload
+}
+
+// reservedUpload is a key handed out by /upload/presign that hasn't been confirmed yet.
+type reservedUpload struct {
+	key         string
+	filename    string
+	contentType string
+	size        int64
+	meta        map[string]string
+	details     photoDetails
+	expires     time.Time
+}
+
+// uploadReservations holds reserved keys by confirmation token. They live in this process
+// only, so the confirm call must reach the instance that presigned.
+type uploadReservations struct {
+	mu      sync.Mutex
+	byToken map[string]reservedUpload
+}
+
+// reserve stores u under a new token. It fails if another unconfirmed upload holds the key.
+// Expired reservations are dropped first.
+func (rs *uploadReservations) reserve(u reservedUpload) (string, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for t, r := range rs.byToken {
+		if now.After(r.expires) {
+			delete(rs.byToken, t)
+		} else if r.key == u.key {
+			return "", newError(ErrConflict, "an upload to "+u.key+" is already in progress")
+		}
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", wrapError(ErrInternal, "could not reserve upload", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if rs.byToken == nil {
+		rs.byToken = make(map[string]reservedUpload)
+	}
+	rs.byToken[token] = u
+	return token, nil
+}
+
+func (rs *uploadReservations) get(token string) (reservedUpload, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	u, ok := rs.byToken[token]
+	if ok && time.Now().After(u.expires) {
+		delete(rs.byToken, token)
+		return reservedUpload{}, false
+	}
+	return u, ok
+}
+
+func (rs *uploadReservations) release(token string) {
+	rs.mu.Lock()
+	delete(rs.byToken, token)
+	rs.mu.Unlock()
+}
+
+// take removes and returns the reservation for token, so only one confirm can act on it.
+func (rs *uploadReservations) take(token string) (reservedUpload, bool) {
+	u, ok := rs.get(token)
+	if ok {
+		rs.release(token)
+	}
+	return u, ok
+}
+
+// restore puts back a reservation taken for a confirm that can be retried.
+func (rs *uploadReservations) restore(token string, u reservedUpload) {
+	rs.mu.Lock()
+	rs.byToken[token] = u
+	rs.mu.Unlock()
+}
+
+// reserved reports whether an unexpired reservation holds key.
+func (rs *uploadReservations) reserved(key string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for _, r := range rs.byToken {
+		if r.key == key && !now.After(r.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// expired removes and returns the reservations that have expired.
+func (rs *uploadReservations) expired() []reservedUpload {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var out []reservedUpload
+	now := time.Now()
+	for t, r := range rs.byToken {
+		if now.After(r.expires) {
+			out = append(out, r)
+			delete(rs.byToken, t)
+		}
+	}
+	return out
+}
+
+// handleUploadPresign validates an upload and returns a presigned PUT URL so the client
+// sends the bytes straight to R2. The PUT must carry the returned headers, which fix the
+// content type, size and metadata. It writes to a private staging key under incomingPrefix;
+// the client then calls confirm_url to have the photo checked and added to the feed.
+func (s *server) handleUploadPresign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	if !requireUploadToken(w, r) {
+		return
+	}
+	if !s.allowUpload(w, r) {
+		return
+	}
+	req, key, meta, details, err := s.parseUploadIntent(w, r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.checkKeyFree(r.Context(), key); err != nil {
+		handleError(w, err)
+		return
+	}
+	// Staged uploads that were never confirmed are cleared out as new ones come in.
+	var abandoned []string
+	for _, u := range s.uploads.expired() {
+		abandoned = append(abandoned, incomingKey(u.key))
+	}
+	if len(abandoned) > 0 {
+		go s.deleteKeys(context.Background(), abandoned)
+	}
+	expires := time.Now().Add(presignUploadTTL)
+	token, err := s.uploads.reserve(reservedUpload{
+		key:         key,
+		filename:    req.Filename,
+		contentType: req.ContentType,
+		size:        req.Size,
+		meta:        meta,
+		details:     details,
+		expires:     expires.Add(presignConfirmGrace),
+	})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	signed, err := s3.NewPresignClient(s.s3Client).PresignPutObject(r.Context(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(incomingKey(key)),
+		ContentType:   aws.String(req.ContentType),
+		ContentLength: aws.Int64(req.Size),
+		ACL:           types.ObjectCannedACLPrivate,
+		Metadata:      meta,
+	}, s3.WithPresignExpires(presignUploadTTL))
+	if err != nil {
+		s.uploads.release(token)
+		handleError(w, wrapError(ErrInternal, "could not presign upload", err))
+		return
+	}
+	headers := make(map[string]string, len(signed.SignedHeader))
+	for name := range signed.SignedHeader {
+		if name != "Host" {
+			headers[name] = signed.SignedHeader.Get(name)
+		}
+	}
+	log.Printf("upload presigned: key=%s size=%d", key, req.Size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":         key,
+		"filename":    req.Filename,
+		"upload_url":  signed.URL,
+		"method":      signed.Method,
+		"headers":     headers,
+		"expires_at":  expires.UTC().Format(time.RFC3339),
+		"confirm_url": "/upload/confirm?token=" + token,
+	})
+}
+
+// parseUploadIntent reads and validates an uploadIntent body, returning it along with the key
+// the file will be stored under, its metadata and its details.
+func (s *server) parseUploadIntent(w http.ResponseWriter, r *http.Request) (req uploadIntent, key string, meta map[string]string, details photoDetails, err error) {
+	s.setUploadLimitHeaders(w)
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, "", nil, details, newError(ErrValidation, "invalid JSON body")
+	}
+	if err := checkUploadType(req.ContentType); err != nil {
+		return req, "", nil, details, err
+	}
+	if req.ContentType == "image/heic" {
+		// Direct uploads skip the server, which is where HEIC is converted.
+		return req, "", nil, details, newError(ErrUnsupportedType, "HEIC images must be sent to /upload or /upload-json")
+	}
+	if req.Size <= 0 {
+		return req, "", nil, details, newError(ErrValidation, "size required")
+	}
+	limit := s.maxUploadBytes
+	if mediaKind(req.ContentType) == "video" {
+		limit = s.maxVideoUploadBytes
+	}
+	if req.Size > limit {
+		return req, "", nil, details, errUploadTooLarge
+	}
+	details, err = parsePhotoDetails(req.Caption, req.Cat, req.UploadedBy)
+	if err != nil {
+		return req, "", nil, details, err
+	}
+	album, err := parseAlbum(req.Album)
+	if err != nil {
+		return req, "", nil, details, err
+	}
+	if details.cat != "" {
+		meta = map[string]string{catMetaName: details.cat}
+	}
+	return req, s.uploadKey(req.Filename, album), meta, details, nil
+}
+
+// handleUploadConfirm publishes a presigned upload once the client's PUT has finished (see
+// publishStaged). After a 5xx the token is restored, so the confirm can be retried.
+func (s *server) handleUploadConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	res, ok := s.uploads.take(token)
+	if !ok {
+		handleError(w, newError(ErrNotFound, "unknown or expired upload token"))
+		return
+	}
+	retryable := s.publishStaged(r.Context(), w, upload{
+		key:         res.key,
+		filename:    res.filename,
+		contentType: res.contentType,
+		size:        res.size,
+		meta:        res.meta,
+		details:     res.details,
+	})
+	if retryable {
+		s.uploads.restore(token, res)
+	}
+}
+
+// publishStaged stores a file the client sent straight to R2, staged privately at
+// incoming/{up.key}. The staged object is checked against up's size and content type, then
+// read back and stored through the same pipeline as /upload (type sniffing, virus scan,
+// moderation, approval), which writes it to its real key and writes the response. The
+// staged copy is deleted once that settles. retryable reports a failure that wasn't the
+// upload's fault, R2 or a 5xx from the pipeline; the staged copy is kept for the retry.
+func (s *server) publishStaged(ctx context.Context, w http.ResponseWriter, up upload) (retryable bool) {
+	staged := incomingKey(up.key)
+	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(staged),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			handleError(w, newError(ErrValidation, "object has not been uploaded yet"))
+			return true
+		}
+		handleError(w, s.r2Error("upload check failed", err))
+		return true
+	}
+	size, contentType := aws.ToInt64(obj.ContentLength), aws.ToString(obj.ContentType)
+	if size != up.size || contentType != up.contentType {
+		obj.Body.Close()
+		s.deleteKeys(context.Background(), []string{staged})
+		handleError(w, newError(ErrUnprocessable, "uploaded object doesn't match the declared upload"))
+		return false
+	}
+	data, err := io.ReadAll(io.LimitReader(obj.Body, up.size+1))
+	obj.Body.Close()
+	if err != nil {
+		handleError(w, s.r2Error("upload check failed", err))
+		return true
+	}
+	up.body, up.size = bytes.NewReader(data), int64(len(data))
+	rec := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+	s.storeUpload(ctx, rec, up)
+	if rec.status >= 500 {
+		return true
+	}
+	s.deleteKeys(context.Background(), []string{staged})
+	log.Printf("staged upload published: key=%s status=%d", up.key, rec.status)
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// moderationReasonMetaName holds why moderation quarantined an upload, on the quarantined
+// copy only.
+const moderationReasonMetaName = "moderation_reason"
+
+// quarantinedPhoto is one entry in the GET /admin/quarantine listing.
+type quarantinedPhoto struct {
+	Key           string    `json:"key"`
+	Reason        string    `json:"reason,omitempty"`
+	ContentType   string    `json:"content_type,omitempty"`
+	Size          int64     `json:"size"`
+	Caption       string    `json:"caption,omitempty"`
+	UploadedBy    string    `json:"uploaded_by,omitempty"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// handleQuarantine serves GET /admin/quarantine: uploads moderation held back, oldest key
+// first, with the reason each was rejected. ?limit caps how many (default 50, at most 200).
+// POST /admin/quarantine/{key}/release publishes one anyway and
+// /admin/quarantine/{key}/delete discards it.
+func (s *server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if rest := strings.TrimPrefix(r.URL.Path, "/admin/quarantine"); rest != "" {
+		s.handleQuarantineAction(w, r, strings.TrimPrefix(rest, "/"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 200 {
+			limit = n
+		}
+	}
+	out, err := s.s3Client.ListObjectsV2(r.Context(), &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(quarantinePrefix),
+		MaxKeys: aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		handleError(w, s.r2Error("quarantine listing failed", err))
+		return
+	}
+	photos := make([]quarantinedPhoto, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		key := strings.TrimPrefix(aws.ToString(obj.Key), quarantinePrefix)
+		d := s.detailsFor(key)
+		p := quarantinedPhoto{Key: key, Size: aws.ToInt64(obj.Size), Caption: d.caption, UploadedBy: d.uploadedBy, QuarantinedAt: aws.ToTime(obj.LastModified)}
+		// The listing doesn't carry metadata; without the reason the entry is still useful.
+		if head, err := s.s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: obj.Key}); err != nil {
+			log.Printf("quarantine head: key=%s err=%v", key, err)
+		} else {
+			p.Reason, p.ContentType = head.Metadata[moderationReasonMetaName], aws.ToString(head.ContentType)
+		}
+		photos = append(photos, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"photos": photos, "truncated": aws.ToBool(out.IsTruncated)})
+}
+
+// handleQuarantineAction serves POST /admin/quarantine/{key}/{action}, release or delete.
+// Keys can contain slashes (albums), so the action is taken from the end of the path.
+func (s *server) handleQuarantineAction(w http.ResponseWriter, r *http.Request, rest string) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	key, action := rest[:i], rest[i+1:]
+	var err error
+	switch action {
+	case "release":
+		err = s.releaseQuarantined(r.Context(), key)
+	case "delete":
+		err = s.deleteQuarantined(r.Context(), key)
+	default:
+		err = newError(ErrNotFound, "not found")
+	}
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	log.Printf("quarantine %s: key=%s", action, key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"key": key, "ok": action})
+}
+
+// releaseQuarantined publishes a quarantined upload as if moderation had passed it: it's
+// written to its key with its derived images, and indexed like any upload (so with
+// REQUIRE_APPROVAL it still waits for approval).
+func (s *server) releaseQuarantined(ctx context.Context, key string) error {
+	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(quarantineKey(key)),
+	})
+	if err != nil {
+		var noKey *types.NoSuchKey
+		if errors.As(err, &noKey) {
+			return newError(ErrNotFound, "photo is not quarantined")
+		}
+		return s.r2Error("release failed", err)
+	}
+	data, err := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return s.r2Error("release failed", err)
+	}
+	contentType := aws.ToString(obj.ContentType)
+	objectMeta := make(map[string]string, len(obj.Metadata))
+	for k, v := range obj.Metadata {
+		if k != moderationReasonMetaName {
+			objectMeta[k] = v
+		}
+	}
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(s.bucket),
+		Key:                aws.String(key),
+		Body:               bytes.NewReader(data),
+		ContentType:        aws.String(contentType),
+		CacheControl:       s.cacheControl(),
+		ContentDisposition: s.contentDisposition("", key),
+		ACL:                s.uploadACL(),
+		Metadata:           objectMeta,
+		IfNoneMatch:        s.uploadIfNoneMatch(),
+	})
+	if isPreconditionFailed(err) {
+		return errKeyExists
+	}
+	if err != nil {
+		return s.r2Error("release failed", err)
+	}
+	head, err := s.headMetadata(ctx, key)
+	if err != nil {
+		log.Printf("release metadata: key=%s err=%v", key, err)
+	}
+	stat := objectStat{modified: time.Now(), size: int64(len(data)), contentType: contentType, width: head.width, height: head.height, takenAt: head.takenAt, animated: head.animated}
+	body := bytes.NewReader(data)
+	stat.thumb, stat.renditions = s.storeImageDerivatives(ctx, key, body)
+	s.transcodeUpload(key, contentType, body)
+	if _, err := s.indexUpload(ctx, key, stat, head.meta, s.detailsFor(key)); err != nil {
+		return err
+	}
+	s.deleteKeys(context.Background(), []string{quarantineKey(key)})
+	return nil
+}
+
+// deleteQuarantined discards a quarantined upload and its record.
+func (s *server) deleteQuarantined(ctx context.Context, key string) error {
+	if _, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(quarantineKey(key)),
+	}); err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return newError(ErrNotFound, "photo is not quarantined")
+		}
+		return s.r2Error("delete failed", err)
+	}
+	if res := s.deleteKeys(ctx, []string{quarantineKey(key)}); !res[0].Deleted {
+		return newError(ErrUpstream, "delete failed: "+res[0].Error)
+	}
+	if err := s.deletePhotoRows(ctx, []string{key}); err != nil {
+		log.Printf("quarantine delete rows: key=%s err=%v", key, err)
+	}
+	s.updatePhotoRecords(func(records map[string]photoRecord) { delete(records, key) })
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// windowLimiter allows up to limit events per key in each fixed window.
+type windowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	counts map[string]*windowCount
+}
+
+type windowCount struct {
+	start time.Time
+	n     int
+}
+
+// newWindowLimiter returns a limiter and starts a goroutine that drops expired windows
+// so idle keys don't accumulate.
+func newWindowLimiter(limit int, window time.Duration) *windowLimiter {
+	l := &windowLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]*windowCount),
+	}
+	go func() {
+		for range time.Tick(window) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// setLimit changes the per-window limit; a limit of 0 or less allows everything.
+func (l *windowLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+}
+
+// allow records an event for key and reports whether it is within the limit.
+// When it isn't, the returned duration is how long until the window resets.
+func (l *windowLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return true, 0
+	}
+	c, ok := l.counts[key]
+	if !ok || now.Sub(c.start) >= l.window {
+		c = &windowCount{start: now}
+		l.counts[key] = c
+	}
+	if c.n >= l.limit {
+		return false, c.start.Add(l.window).Sub(now)
+	}
+	c.n++
+	return true, 0
+}
+
+func (l *windowLimiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, c := range l.counts {
+		if now.Sub(c.start) >= l.window {
+			delete(l.counts, k)
+		}
+	}
+}
+
+// distinctLimiter allows up to limit distinct values per key in each fixed window. Repeats
+// of a value already counted in the current window are always allowed.
+type distinctLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	sets   map[string]*windowSet
+}
+
+type windowSet struct {
+	start  time.Time
+	values map[string]struct{}
+}
+
+// newDistinctLimiter returns a limiter and starts a goroutine that drops expired windows.
+func newDistinctLimiter(limit int, window time.Duration) *distinctLimiter {
+	l := &distinctLimiter{
+		limit:  limit,
+		window: window,
+		sets:   make(map[string]*windowSet),
+	}
+	go func() {
+		for range time.Tick(window) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// setLimit changes the per-window limit; a limit of 0 or less allows everything.
+func (l *distinctLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+}
+
+// allow records value under key and reports whether key is within its distinct-value limit.
+// When it isn't, the returned duration is how long until the window resets.
+func (l *distinctLimiter) allow(key, value string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return true, 0
+	}
+	ws, ok := l.sets[key]
+	if !ok || now.Sub(ws.start) >= l.window {
+		ws = &windowSet{start: now, values: make(map[string]struct{})}
+		l.sets[key] = ws
+	}
+	if _, seen := ws.values[value]; seen {
+		return true, 0
+	}
+	if len(ws.values) >= l.limit {
+		return false, ws.start.Add(l.window).Sub(now)
+	}
+	ws.values[value] = struct{}{}
+	return true, 0
+}
+
+func (l *distinctLimiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, ws := range l.sets {
+		if now.Sub(ws.start) >= l.window {
+			delete(l.sets, k)
+		}
+	}
+}
+
+// tokenLimiter is a token bucket per key: up to burst events at once, refilled at a steady
+// rate. Unlike windowLimiter it doesn't let a client spend a whole window's allowance at once
+// twice across a window boundary.
+type tokenLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second; 0 or less allows everything
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newTokenLimiter returns a limiter allowing perMin events a minute per key with bursts of up
+// to burst, and starts a goroutine that drops full buckets so idle keys don't accumulate.
+func newTokenLimiter(perMin, burst int) *tokenLimiter {
+	l := &tokenLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setLimit(perMin, burst)
+	go func() {
+		for range time.Tick(time.Minute) {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// setLimit changes the rate and burst; a rate of 0 or less allows everything.
+func (l *tokenLimiter) setLimit(perMin, burst int) {
+	l.mu.Lock()
+	l.rate = float64(perMin) / 60
+	l.burst = float64(max(burst, 1))
+	l.mu.Unlock()
+}
+
+// allow takes a token for key and reports whether there was one. When there wasn't, the
+// returned duration is how long until there will be.
+func (l *tokenLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *tokenLimiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, b := range l.buckets {
+		if l.rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// clientIP returns the caller's address. The first X-Forwarded-For hop is only trusted when
+// TRUST_FORWARDED_FOR is set, since clients can send the header themselves.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_FORWARDED_FOR") != "" {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisSeenPrefix    = "feed:seen:"
+	redisFeedObjects   = "feed:objects"
+	redisFeedChannel   = "feed:changes"
+	redisScanBatchSize = 500
+)
+
+// redisSeenStore keeps each seen-set as a Redis set so every instance shares it.
+type redisSeenStore struct {
+	rdb *redis.Client
+}
+
+func (r *redisSeenStore) seen(ctx context.Context, sk string) (map[string]struct{}, error) {
+	members, err := r.rdb.SMembers(ctx, redisSeenPrefix+sk).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]struct{}, len(members))
+	for _, m := range members {
+		out[m] = struct{}{}
+	}
+	return out, nil
+}
+
+func (r *redisSeenStore) markSeen(ctx context.Context, sk string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.rdb.SAdd(ctx, redisSeenPrefix+sk, toAny(keys)...).Err()
+}
+
+func (r *redisSeenStore) unmarkSeen(ctx context.Context, sk string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.rdb.SRem(ctx, redisSeenPrefix+sk, toAny(keys)...).Err()
+}
+
+// purge removes keys from every seen-set, walking them with SCAN.
+func (r *redisSeenStore) purge(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	members := toAny(keys)
+	iter := r.rdb.Scan(ctx, 0, redisSeenPrefix+"*", redisScanBatchSize).Iterator()
+	for iter.Next(ctx) {
+		if err := r.rdb.SRem(ctx, iter.Val(), members...).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (r *redisSeenStore) reset(ctx context.Context, sk string) (int, error) {
+	var card *redis.IntCmd
+	_, err := r.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		card = p.SCard(ctx, redisSeenPrefix+sk)
+		p.Del(ctx, redisSeenPrefix+sk)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(card.Val()), nil
+}
+
+func (r *redisSeenStore) evict(string) {}
+
+// feedIndexStore shares the feed index between instances. Each instance still serves from its
+// own feedByKey; changes are written through to the store and other instances reload on
+// notification. Without one (the default) the index is local to the process.
+type feedIndexStore interface {
+	load(ctx context.Context) (map[string]snapshotObject, error)
+	put(ctx context.Context, key string, obj snapshotObject) error
+	remove(ctx context.Context, keys []string) error
+	replace(ctx context.Context, objs map[string]snapshotObject) error
+	// subscribe calls onChange whenever another writer changes the index.
+	subscribe(ctx context.Context, onChange func())
+}
+
+// redisFeedIndex stores the index as a hash of key -> JSON snapshotObject and announces
+// changes on a pub/sub channel.
+type redisFeedIndex struct {
+	rdb *redis.Client
+}
+
+func (r *redisFeedIndex) load(ctx context.Context) (map[string]snapshotObject, error) {
+	raw, err := r.rdb.HGetAll(ctx, redisFeedObjects).Result()
+	if err != nil {
+		return nil, err
+	}
+	objs := make(map[string]snapshotObject, len(raw))
+	for k, v := range raw {
+		var o snapshotObject
+		if err := json.Unmarshal([]byte(v), &o); err != nil {
+			log.Printf("redis feed index: skipping %s: %v", k, err)
+			continue
+		}
+		objs[k] = o
+	}
+	return objs, nil
+}
+
+func (r *redisFeedIndex) put(ctx context.Context, key string, obj snapshotObject) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if err := r.rdb.HSet(ctx, redisFeedObjects, key, data).Err(); err != nil {
+		return err
+	}
+	return r.rdb.Publish(ctx, redisFeedChannel, "put").Err()
+}
+
+func (r *redisFeedIndex) remove(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := r.rdb.HDel(ctx, redisFeedObjects, keys...).Err(); err != nil {
+		return err
+	}
+	return r.rdb.Publish(ctx, redisFeedChannel, "remove").Err()
+}
+
+func (r *redisFeedIndex) replace(ctx context.Context, objs map[string]snapshotObject) error {
+	fields := make(map[string]interface{}, len(objs))
+	for k, o := range objs {
+		data, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		fields[k] = data
+	}
+	_, err := r.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, redisFeedObjects)
+		if len(fields) > 0 {
+			p.HSet(ctx, redisFeedObjects, fields)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.rdb.Publish(ctx, redisFeedChannel, "replace").Err()
+}
+
+func (r *redisFeedIndex) subscribe(ctx context.Context, onChange func()) {
+	sub := r.rdb.Subscribe(ctx, redisFeedChannel)
+	go func() {
+		defer sub.Close()
+		for range sub.Channel() {
+			onChange()
+		}
+	}()
+}
+
+// shareFeedObject writes key's index entry through to the shared store, if any.
+func (s *server) shareFeedObject(ctx context.Context, key string, obj snapshotObject) {
+	if s.feedIndex == nil {
+		return
+	}
+	if err := s.feedIndex.put(ctx, key, obj); err != nil {
+		log.Printf("shared feed index put: key=%s err=%v", key, err)
+	}
+}
+
+// shareFeedRemoval removes keys from the shared store, if any.
+func (s *server) shareFeedRemoval(ctx context.Context, keys []string) {
+	if s.feedIndex == nil || len(keys) == 0 {
+		return
+	}
+	if err := s.feedIndex.remove(ctx, keys); err != nil {
+		log.Printf("shared feed index remove: %v", err)
+	}
+}
+
+// shareFeedIndex replaces the shared store's contents with this instance's index, if any.
+func (s *server) shareFeedIndex(ctx context.Context) {
+	if s.feedIndex == nil {
+		return
+	}
+	if err := s.feedIndex.replace(ctx, s.feedObjects()); err != nil {
+		log.Printf("shared feed index replace: %v", err)
+	}
+}
+
+// reloadFeedIndex replaces this instance's index with the shared store's.
+func (s *server) reloadFeedIndex(ctx context.Context) {
+	objs, err := s.feedIndex.load(ctx)
+	if err != nil {
+		log.Printf("shared feed index load: %v", err)
+		return
+	}
+	s.setFeedObjects(objs)
+}
+
+func toAny(keys []string) []interface{} {
+	out := make([]interface{}, len(keys))
+	for i, k := range keys {
+		out[i] = k
+	}
+	return out
+}
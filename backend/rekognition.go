@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// rekognitionClient calls the AWS Rekognition JSON API directly, signed with the AWS SDK, for
+// the two image checks the server needs.
+type rekognitionClient struct {
+	cfg aws.Config
+}
+
+// newRekognitionClient uses REKOGNITION_REGION and AWS credentials from the usual AWS_*
+// variables, which are separate from R2's.
+func newRekognitionClient(ctx context.Context) (*rekognitionClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(envOr("REKOGNITION_REGION", "us-east-1")))
+	if err != nil {
+		return nil, err
+	}
+	return &rekognitionClient{cfg: cfg}, nil
+}
+
+// rekognitionLabel is a label in a DetectLabels or DetectModerationLabels response.
+type rekognitionLabel struct {
+	Name       string
+	Confidence float64
+}
+
+// labels runs action (DetectLabels or DetectModerationLabels) on an image and returns the
+// labels found with at least minConfidence percent.
+func (c *rekognitionClient) labels(ctx context.Context, action string, data []byte, minConfidence float64) ([]rekognitionLabel, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"Image":         map[string]string{"Bytes": base64.StdEncoding.EncodeToString(data)},
+		"MinConfidence": minConfidence,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://rekognition."+c.cfg.Region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "RekognitionService."+action)
+	creds, err := c.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "rekognition", c.cfg.Region, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("rekognition %s: %s: %s", action, resp.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		Labels           []rekognitionLabel
+		ModerationLabels []rekognitionLabel
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return append(out.Labels, out.ModerationLabels...), nil
+}
+
+func formatLabels(labels []rekognitionLabel) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.Name + " (" + strconv.FormatFloat(l.Confidence, 'f', 0, 64) + "%)"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rekognitionModerator rejects images Rekognition finds moderation labels in with at least
+// minConfidence percent (REKOGNITION_MIN_CONFIDENCE).
+type rekognitionModerator struct {
+	client        *rekognitionClient
+	minConfidence float64
+}
+
+func (m *rekognitionModerator) check(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	labels, err := m.client.labels(ctx, "DetectModerationLabels", data, m.minConfidence)
+	if err != nil || len(labels) == 0 {
+		return "", err
+	}
+	return "rekognition: " + formatLabels(labels), nil
+}
+
+// catDetector sends images Rekognition doesn't see a cat in, with at least minConfidence
+// percent (CAT_MIN_CONFIDENCE), to the review queue.
+type catDetector struct {
+	client        *rekognitionClient
+	minConfidence float64
+}
+
+func (d *catDetector) check(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	labels, err := d.client.labels(ctx, "DetectLabels", data, d.minConfidence)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range labels {
+		if l.Name == "Cat" {
+			return "", nil
+		}
+	}
+	return "no cat detected", nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"image"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// renditionPrefix holds resized copies of photos at renditions/{size}/{key}, size being the
+// longest side in pixels. Like thumbnails they're JPEG and never feed items themselves.
+const renditionPrefix = "renditions/"
+
+func renditionKey(key string, size int) string {
+	return renditionPrefix + strconv.Itoa(size) + "/" + key
+}
+
+func isRenditionKey(key string) bool {
+	return strings.HasPrefix(key, renditionPrefix)
+}
+
+// parseRenditionKey splits a rendition key into the photo key and size.
+func parseRenditionKey(k string) (key string, size int, ok bool) {
+	sizePart, key, ok := strings.Cut(strings.TrimPrefix(k, renditionPrefix), "/")
+	if !ok || key == "" {
+		return "", 0, false
+	}
+	size, err := strconv.Atoi(sizePart)
+	if err != nil || size <= 0 {
+		return "", 0, false
+	}
+	return key, size, true
+}
+
+// parseRenditionSizes reads a comma-separated list of sizes (RENDITION_SIZES), ascending;
+// invalid entries are skipped.
+func parseRenditionSizes(v string) []int {
+	var sizes []int
+	for _, f := range strings.Split(v, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(f)); err == nil && n > 0 && !slices.Contains(sizes, n) {
+			sizes = append(sizes, n)
+		}
+	}
+	slices.Sort(sizes)
+	return sizes
+}
+
+// storeRenditions writes a rendition of src for each configured size smaller than its
+// longest side, returning the sizes stored. Larger sizes would only copy the original, which
+// /feed serves for them anyway.
+func (s *server) storeRenditions(ctx context.Context, key string, src image.Image) []int {
+	b := src.Bounds()
+	longest := max(b.Dx(), b.Dy())
+	var stored []int
+	for _, size := range s.renditionSizes {
+		if size >= longest {
+			break
+		}
+		if s.putJPEG(ctx, renditionKey(key, size), scaleDown(src, size)) {
+			stored = append(stored, size)
+		}
+	}
+	return stored
+}
+
+// parseRenditionSize reads the /feed size param: the longest side the client will display,
+// in pixels. 0 means the original.
+func parseRenditionSize(q url.Values) (int, error) {
+	v := q.Get("size")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, newError(ErrValidation, "size must be a positive number of pixels")
+	}
+	return n, nil
+}
+
+// applyRenditionSize swaps the urls in a feedResponse body for the smallest rendition of each
+// photo at least size pixels on its longest side, keeping the original where there's none.
+// The urls the batch was picked by are unchanged, so seen tracking still uses the originals.
+func (s *server) applyRenditionSize(resp map[string]interface{}, urls []string, size int) {
+	if size <= 0 {
+		return
+	}
+	var at []int
+	var picked []string
+	s.feedByKeyMu.RLock()
+	for i, u := range urls {
+		key := s.urlKey(u)
+		st := s.feedStat[key]
+		if j := slices.IndexFunc(st.renditions, func(r int) bool { return r >= size }); j >= 0 {
+			at = append(at, i)
+			picked = append(picked, s.bucketURL(st.bucket, renditionKey(key, st.renditions[j])))
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+	if len(picked) == 0 {
+		return
+	}
+	signed := s.signFeedURLs(picked)
+	items, _ := resp["items"].([]map[string]interface{})
+	bare, _ := resp["urls"].([]string)
+	for n, i := range at {
+		if _, ok := items[i]["url"]; ok {
+			items[i]["url"] = signed[n]
+		}
+		if bare != nil {
+			bare[i] = signed[n]
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	resumablePrefix = "/upload/resumable/"
+	// resumablePartSize is the least data sent to R2 as one multipart part; every part but
+	// the last must be at least 5 MB.
+	resumablePartSize = 5 << 20
+	// resumableMaxChunk caps one PATCH body, which is held in memory.
+	resumableMaxChunk = 16 << 20
+	// resumableTTL is how long a resumable upload may take from start to finish.
+	resumableTTL = 24 * time.Hour
+)
+
+// resumableUpload is one upload in progress. Bytes are accepted in order at the current
+// offset (like tus.io's core protocol) and buffered until there's a full part for R2. Like a
+// presigned upload, it's assembled privately at incoming/{key} and only published once it's
+// complete.
+type resumableUpload struct {
+	mu          sync.Mutex
+	key         string
+	filename    string
+	contentType string
+	size        int64
+	meta        map[string]string
+	details     photoDetails
+	s3UploadID  string
+	// completed is set once the parts are assembled into the staged object, so a retry
+	// after a failed publish goes straight back to publishing it.
+	completed bool
+	parts     []types.CompletedPart
+	buf       []byte // received but not yet sent as a part
+	offset    int64  // bytes received, including buf
+	expires   time.Time
+}
+
+// resumableUploads holds uploads in progress by ID. Like presign reservations they live in
+// this process only.
+type resumableUploads struct {
+	mu   sync.Mutex
+	byID map[string]*resumableUpload
+}
+
+func (ru *resumableUploads) get(id string) (*resumableUpload, bool) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	u, ok := ru.byID[id]
+	return u, ok && time.Now().Before(u.expires)
+}
+
+func (ru *resumableUploads) put(id string, u *resumableUpload) {
+	ru.mu.Lock()
+	if ru.byID == nil {
+		ru.byID = make(map[string]*resumableUpload)
+	}
+	ru.byID[id] = u
+	ru.mu.Unlock()
+}
+
+func (ru *resumableUploads) remove(id string) {
+	ru.mu.Lock()
+	delete(ru.byID, id)
+	ru.mu.Unlock()
+}
+
+// expired removes and returns the uploads past their deadline.
+func (ru *resumableUploads) expired() []*resumableUpload {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	var out []*resumableUpload
+	now := time.Now()
+	for id, u := range ru.byID {
+		if now.After(u.expires) {
+			out = append(out, u)
+			delete(ru.byID, id)
+		}
+	}
+	return out
+}
+
+// handleResumableCreate starts a resumable upload from an uploadIntent body. The response's
+// upload_url (also the Location header) takes the bytes in PATCH requests.
+func (s *server) handleResumableCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	if !requireUploadToken(w, r) {
+		return
+	}
+	if !s.allowUpload(w, r) {
+		return
+	}
+	req, key, meta, details, err := s.parseUploadIntent(w, r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.checkKeyFree(r.Context(), key); err != nil {
+		handleError(w, err)
+		return
+	}
+	for _, u := range s.resumable.expired() {
+		go s.discardResumable(u)
+	}
+	expires := time.Now().Add(resumableTTL)
+	id, err := s.uploads.reserve(reservedUpload{key: key, contentType: req.ContentType, size: req.Size, meta: meta, details: details, expires: expires})
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	out, err := s.s3Client.CreateMultipartUpload(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(incomingKey(key)),
+		ContentType: aws.String(req.ContentType),
+		ACL:         types.ObjectCannedACLPrivate,
+	})
+	if err != nil {
+		s.uploads.release(id)
+		handleError(w, s.r2Error("could not start upload", err))
+		return
+	}
+	s.resumable.put(id, &resumableUpload{
+		key:         key,
+		filename:    req.Filename,
+		contentType: req.ContentType,
+		size:        req.Size,
+		meta:        meta,
+		details:     details,
+		s3UploadID:  aws.ToString(out.UploadId),
+		expires:     expires,
+	})
+	log.Printf("resumable upload started: key=%s size=%d", key, req.Size)
+	loc := resumablePrefix + id
+	w.Header().Set("Location", loc)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":        key,
+		"filename":   req.Filename,
+		"upload_url": loc,
+		"offset":     0,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+// handleResumable serves /upload/resumable/{id}: HEAD or GET for the current offset, PATCH
+// with an Upload-Offset header to append bytes, DELETE to abandon the upload. The PATCH that
+// reaches the declared size completes the upload and publishes it, responding as /upload
+// does; after a failed PATCH, a client should re-read the offset and resend from there (an
+// empty PATCH retries the publish once every byte is in).
+func (s *server) handleResumable(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, resumablePrefix)
+	u, ok := s.resumable.get(id)
+	if !ok {
+		handleError(w, newError(ErrNotFound, "unknown or expired upload"))
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		u.mu.Lock()
+		offset := u.offset
+		u.mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": u.key, "offset": offset, "size": u.size})
+		}
+	case http.MethodPatch:
+		if s.rejectIfMaintenance(w) {
+			return
+		}
+		s.appendResumable(w, r, id, u)
+	case http.MethodDelete:
+		s.resumable.remove(id)
+		s.uploads.release(id)
+		s.discardResumable(u)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		handleError(w, errMethodNotAllowed)
+	}
+}
+
+// appendResumable handles a PATCH: it accepts the body at the client's offset, sends full
+// parts on to R2 and completes the upload once every byte has arrived.
+func (s *server) appendResumable(w http.ResponseWriter, r *http.Request, id string, u *resumableUpload) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "Upload-Offset header required"))
+		return
+	}
+	// The body is read without holding the lock so a stalled connection doesn't block offset
+	// queries from the client's retry; the offset is checked again before appending.
+	u.mu.Lock()
+	current := u.offset
+	u.mu.Unlock()
+	if offset != current {
+		offsetConflict(w, current)
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, min(u.size-offset, resumableMaxChunk)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			handleError(w, newError(ErrTooLarge, "chunk exceeds the remaining size or "+strconv.Itoa(resumableMaxChunk)+" bytes"))
+			return
+		}
+		handleError(w, newError(ErrValidation, "could not read chunk"))
+		return
+	}
+	// Catch a wrong file type on the first chunk rather than after the whole upload; the
+	// upload pipeline sniffs it again on completion either way.
+	if offset == 0 && int64(len(chunk)) >= min(u.size, 512) {
+		if typ := detectMediaType(chunk[:min(len(chunk), 512)]); typ != u.contentType {
+			s.resumable.remove(id)
+			s.uploads.release(id)
+			s.abortMultipart(u)
+			handleError(w, newError(ErrUnsupportedType, "uploaded file is "+typ+", not "+u.contentType))
+			return
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if offset != u.offset {
+		offsetConflict(w, u.offset)
+		return
+	}
+	u.buf = append(u.buf, chunk...)
+	u.offset += int64(len(chunk))
+
+	done := u.offset == u.size
+	if len(u.buf) >= resumablePartSize || (done && len(u.buf) > 0) {
+		if err := s.sendPart(r.Context(), u); err != nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+			handleError(w, s.r2Error("chunk upload failed", err))
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	if done {
+		s.completeResumable(r.Context(), w, id, u)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"offset": u.offset})
+}
+
+// offsetConflict rejects a PATCH whose Upload-Offset isn't where the upload stands.
+func offsetConflict(w http.ResponseWriter, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	handleError(w, newError(ErrConflict, "Upload-Offset doesn't match the upload's offset "+strconv.FormatInt(offset, 10)))
+}
+
+// sendPart uploads u's buffer as the next part. On failure the buffer is kept, so a later
+// PATCH (an empty one will do once every byte is in) retries it. Must be called with u.mu held.
+func (s *server) sendPart(ctx context.Context, u *resumableUpload) error {
+	n := int32(len(u.parts) + 1)
+	out, err := s.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(incomingKey(u.key)),
+		UploadId:   aws.String(u.s3UploadID),
+		PartNumber: aws.Int32(n),
+		Body:       bytes.NewReader(u.buf),
+	})
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(n)})
+	u.buf = nil
+	return nil
+}
+
+// completeResumable assembles the parts into the staged object, unless an earlier attempt
+// already did, then publishes it (see publishStaged), which writes the response. The upload
+// is kept for another PATCH after a failure that can be retried, and dropped otherwise. Must
+// be called with u.mu held.
+func (s *server) completeResumable(ctx context.Context, w http.ResponseWriter, id string, u *resumableUpload) {
+	if !u.completed {
+		_, err := s.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(incomingKey(u.key)),
+			UploadId:        aws.String(u.s3UploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: u.parts},
+		})
+		if err != nil {
+			handleError(w, s.r2Error("could not complete upload", err))
+			return
+		}
+		u.completed = true
+		log.Printf("resumable upload assembled: key=%s parts=%d", u.key, len(u.parts))
+	}
+	// The reservation is let go while publishing, as for a presign confirm: the feed skips
+	// reserved keys, and this one is about to be indexed.
+	res, reserved := s.uploads.take(id)
+	retryable := s.publishStaged(ctx, w, upload{
+		key:         u.key,
+		filename:    u.filename,
+		contentType: u.contentType,
+		size:        u.size,
+		meta:        u.meta,
+		details:     u.details,
+	})
+	if retryable {
+		if reserved {
+			s.uploads.restore(id, res)
+		}
+		return
+	}
+	s.resumable.remove(id)
+}
+
+// discardResumable cleans up after an abandoned upload: its parts, or the staged object
+// when they've already been assembled.
+func (s *server) discardResumable(u *resumableUpload) {
+	u.mu.Lock()
+	completed := u.completed
+	u.mu.Unlock()
+	if completed {
+		s.deleteKeys(context.Background(), []string{incomingKey(u.key)})
+		return
+	}
+	s.abortMultipart(u)
+}
+
+// abortMultipart discards the parts of an abandoned upload; failures are only logged, and
+// a bucket lifecycle rule is the backstop.
+func (s *server) abortMultipart(u *resumableUpload) {
+	_, err := s.s3Client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(incomingKey(u.key)),
+		UploadId: aws.String(u.s3UploadID),
+	})
+	if err != nil {
+		log.Printf("resumable upload abort: key=%s err=%v", u.key, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// rssDefaultItems is how many of the newest uploads /feed.rss and /feed.atom list
+	// without a limit param.
+	rssDefaultItems = 50
+	feedTitle       = "Namu and Rocky"
+)
+
+// objectStat is what the feed knows about an object beyond its URL and user metadata.
+// contentType and dimensions are only known for objects uploaded through this server or
+// picked up by the metadata sync.
+type objectStat struct {
+	modified      time.Time
+	size          int64
+	contentType   string
+	width, height int
+	thumb         bool     // a thumbnail exists at thumbKey
+	renditions    []int    // sizes with a rendition at renditionKey, ascending
+	formats       []string // transcoded copies at formatKey (see imageFormats)
+	bucket        string   // source bucket; "" for the primary one
+	takenAt       time.Time
+	animated      bool // an animated GIF
+}
+
+// takenOrModified is when the photo was taken if known, else when it was stored.
+func (st objectStat) takenOrModified() time.Time {
+	if !st.takenAt.IsZero() {
+		return st.takenAt
+	}
+	return st.modified
+}
+
+func statFromObject(obj types.Object) objectStat {
+	return objectStat{modified: aws.ToTime(obj.LastModified), size: aws.ToInt64(obj.Size)}
+}
+
+// guessContentType derives a type from the key's extension for objects whose stored type
+// isn't known.
+func guessContentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if typ, ok := mediaExtensions[ext]; ok {
+		return typ
+	}
+	if typ := mime.TypeByExtension(ext); typ != "" {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	Link      string       `xml:"link"`
+	GUID      rssGUID      `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// syndicationEntry is one photo in the RSS or Atom feed.
+type syndicationEntry struct {
+	key, url  string
+	signedURL string
+	stat      objectStat
+}
+
+func (e syndicationEntry) contentType() string {
+	if e.stat.contentType != "" {
+		return e.stat.contentType
+	}
+	return guessContentType(e.key)
+}
+
+// recentEntries returns the newest uploads for the syndication feeds, newest first, with
+// ties broken by key so the order is stable. Unlike /feed nothing is tracked per client.
+func (s *server) recentEntries(r *http.Request) []syndicationEntry {
+	limit := rssDefaultItems
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	s.feedByKeyMu.RLock()
+	entries := make([]syndicationEntry, 0, len(s.feedByKey))
+	for k, u := range s.feedByKey {
+		entries = append(entries, syndicationEntry{key: k, url: u, stat: s.feedStat[k]})
+	}
+	s.feedByKeyMu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].stat.modified.Equal(entries[j].stat.modified) {
+			return entries[i].stat.modified.After(entries[j].stat.modified)
+		}
+		return entries[i].key < entries[j].key
+	})
+	entries = entries[:min(limit, len(entries))]
+
+	urls := make([]string, len(entries))
+	for i, e := range entries {
+		urls[i] = e.url
+	}
+	for i, u := range s.signFeedURLs(urls) {
+		entries[i].signedURL = u
+	}
+	return entries
+}
+
+// siteURL is the link the feeds point readers at: the root of this server.
+func siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/"
+}
+
+// handleFeedRSS lists the most recent uploads as an RSS 2.0 document with each image as an
+// enclosure.
+func (s *server) handleFeedRSS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	entries := s.recentEntries(r)
+	doc := rssDoc{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       feedTitle,
+			Link:        siteURL(r),
+			Description: "New photos of Namu and Rocky",
+			Items:       make([]rssItem, len(entries)),
+		},
+	}
+	if len(entries) > 0 && !entries[0].stat.modified.IsZero() {
+		doc.Channel.LastBuildDate = entries[0].stat.modified.UTC().Format(time.RFC1123Z)
+	}
+	for i, e := range entries {
+		doc.Channel.Items[i] = rssItem{
+			Title:     e.key,
+			Link:      e.signedURL,
+			GUID:      rssGUID{Value: e.url},
+			PubDate:   e.stat.modified.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{URL: e.signedURL, Length: e.stat.size, Type: e.contentType()},
+		}
+	}
+	writeXML(w, r, "application/rss+xml; charset=utf-8", doc)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+}
+
+// handleFeedAtom is the Atom 1.0 counterpart of handleFeedRSS.
+func (s *server) handleFeedAtom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	entries := s.recentEntries(r)
+	site := siteURL(r)
+	feed := atomFeed{
+		Title:   feedTitle,
+		ID:      site,
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: feedTitle},
+		Links: []atomLink{
+			{Rel: "alternate", Href: site},
+			{Rel: "self", Href: strings.TrimSuffix(site, "/") + r.URL.Path},
+		},
+		Entries: make([]atomEntry, len(entries)),
+	}
+	if len(entries) > 0 && !entries[0].stat.modified.IsZero() {
+		feed.Updated = entries[0].stat.modified.UTC().Format(time.RFC3339)
+	}
+	for i, e := range entries {
+		feed.Entries[i] = atomEntry{
+			Title:   e.key,
+			ID:      e.url,
+			Updated: e.stat.modified.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Href: e.signedURL},
+				{Rel: "enclosure", Href: e.signedURL, Type: e.contentType(), Length: e.stat.size},
+			},
+		}
+	}
+	writeXML(w, r, "application/atom+xml; charset=utf-8", feed)
+}
+
+// writeXML writes v as an indented XML document (headers only for HEAD).
+func writeXML(w http.ResponseWriter, r *http.Request, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(v)
+}
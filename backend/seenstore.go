@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// seenStore records which photo keys each seen key (see seenKey) has already been served.
+// The in-memory store is the default; SEEN_STORE=postgres shares the state across restarts
+// and replicas. Ack-mode pending batches stay in memory either way.
+type seenStore interface {
+	// seen returns a copy of the photo keys sk has been served.
+	seen(ctx context.Context, sk string) (map[string]struct{}, error)
+	markSeen(ctx context.Context, sk string, keys []string) error
+	unmarkSeen(ctx context.Context, sk string, keys []string) error
+	// purge forgets keys for every client, e.g. after the photos are deleted.
+	purge(ctx context.Context, keys []string) error
+	// reset empties sk's seen-set and returns how many keys it held.
+	reset(ctx context.Context, sk string) (int, error)
+	// evict is called when the server stops tracking sk (see touchClient). Persistent stores
+	// keep the rows.
+	evict(sk string)
+}
+
+// memorySeenStore keeps seen-sets in process memory; they're lost on restart.
+type memorySeenStore struct {
+	mu   sync.Mutex
+	sets map[string]map[string]struct{}
+}
+
+func newMemorySeenStore() *memorySeenStore {
+	return &memorySeenStore{sets: make(map[string]map[string]struct{})}
+}
+
+func (m *memorySeenStore) seen(_ context.Context, sk string) (map[string]struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]struct{}, len(m.sets[sk]))
+	for k := range m.sets[sk] {
+		out[k] = struct{}{}
+	}
+	return out, nil
+}
+
+func (m *memorySeenStore) markSeen(_ context.Context, sk string, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sets[sk]
+	if !ok {
+		set = make(map[string]struct{})
+		m.sets[sk] = set
+	}
+	for _, k := range keys {
+		set[k] = struct{}{}
+	}
+	return nil
+}
+
+func (m *memorySeenStore) unmarkSeen(_ context.Context, sk string, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		delete(m.sets[sk], k)
+	}
+	return nil
+}
+
+func (m *memorySeenStore) purge(_ context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, set := range m.sets {
+		for _, k := range keys {
+			delete(set, k)
+		}
+	}
+	return nil
+}
+
+func (m *memorySeenStore) reset(_ context.Context, sk string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.sets[sk])
+	delete(m.sets, sk)
+	return n, nil
+}
+
+func (m *memorySeenStore) evict(sk string) {
+	m.mu.Lock()
+	delete(m.sets, sk)
+	m.mu.Unlock()
+}
+
+// postgresSeenStore keeps seen-sets in the feed_seen table.
+type postgresSeenStore struct {
+	db *sql.DB
+}
+
+// newPostgresSeenStore creates the feed_seen table if needed.
+func newPostgresSeenStore(ctx context.Context, db *sql.DB) (*postgresSeenStore, error) {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS feed_seen (
+			client_key TEXT NOT NULL,
+			photo_key TEXT NOT NULL,
+			seen_at TIMESTAMPTZ DEFAULT NOW(),
+
+			PRIMARY KEY (client_key, photo_key)
+		);
+		CREATE INDEX IF NOT EXISTS feed_seen_photo_key ON feed_seen (photo_key);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresSeenStore{db: db}, nil
+}
+
+// pgClientKey swaps the NUL separator seenKey uses for device keys, since Postgres text
+// can't hold NUL bytes.
+func pgClientKey(sk string) string {
+	return strings.ReplaceAll(sk, "\x00", "\x1f")
+}
+
+func (p *postgresSeenStore) seen(ctx context.Context, sk string) (map[string]struct{}, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT photo_key FROM feed_seen WHERE client_key = $1`, pgClientKey(sk))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]struct{})
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		out[k] = struct{}{}
+	}
+	return out, rows.Err()
+}
+
+func (p *postgresSeenStore) markSeen(ctx context.Context, sk string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO feed_seen (client_key, photo_key)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT (client_key, photo_key) DO UPDATE SET seen_at = NOW()
+	`, pgClientKey(sk), pq.Array(keys))
+	return err
+}
+
+func (p *postgresSeenStore) unmarkSeen(ctx context.Context, sk string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := p.db.ExecContext(ctx, `DELETE FROM feed_seen WHERE client_key = $1 AND photo_key = ANY($2)`,
+		pgClientKey(sk), pq.Array(keys))
+	return err
+}
+
+func (p *postgresSeenStore) purge(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := p.db.ExecContext(ctx, `DELETE FROM feed_seen WHERE photo_key = ANY($1)`, pq.Array(keys))
+	return err
+}
+
+func (p *postgresSeenStore) reset(ctx context.Context, sk string) (int, error) {
+	res, err := p.db.ExecContext(ctx, `DELETE FROM feed_seen WHERE client_key = $1`, pgClientKey(sk))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (p *postgresSeenStore) evict(string) {}
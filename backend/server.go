@@ -0,0 +1,237 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/singleflight"
+)
+
+// server holds the dependencies and in-memory state shared by the HTTP handlers.
+type server struct {
+	db       *sql.DB
+	s3Client *s3.Client
+	bucket   string // primary bucket; uploads go here
+	// extraBuckets are read-only buckets merged into the feed (see bucketSource).
+	extraBuckets []bucketSource
+	// r2Breaker guards every call s3Client makes; see breakerHTTPClient.
+	r2Breaker *circuitBreaker
+
+	// feedURLBase is the prefix feed URLs are built from: R2_PUBLIC_BASE_URL, or this
+	// server's /image endpoint in proxy mode.
+	feedURLBase string
+	imageProxy  bool
+	signer      *urlSigner // nil unless URL_SIGNING_SECRET is set
+	// presigner replaces feed URLs with presigned GETs for private buckets (PRESIGN_URLS).
+	presigner *s3.PresignClient
+
+	// syncObjectMetadata enables HeadObject calls after listing to capture metadata for
+	// objects uploaded before this process started. ListObjectsV2 doesn't return metadata,
+	// so this costs one request per object; it's set from SYNC_OBJECT_METADATA.
+	syncObjectMetadata bool
+	// keepUploadFilenames stores uploads under the file name as sent (KEEP_UPLOAD_FILENAMES),
+	// overwriting any earlier upload of the same name, instead of a unique key.
+	keepUploadFilenames bool
+	// uploadOverwrite is the UPLOAD_OVERWRITE mode: whether an upload may replace an existing
+	// object (see overwriteReject).
+	uploadOverwrite string
+	// requireApproval holds uploads in pending_photos until an admin approves them
+	// (REQUIRE_APPROVAL); see holdForApproval.
+	requireApproval bool
+	// virusScanner scans every upload before it's published (VIRUS_SCAN); nil when off.
+	virusScanner virusScanner
+	// moderator checks images before they're published (MODERATION); nil when off.
+	moderator moderator
+
+	// maxUploadBytes caps the decoded size of an upload on both /upload and /upload-json.
+	maxUploadBytes int64
+	// maxVideoUploadBytes is the same cap for video uploads.
+	maxVideoUploadBytes int64
+	// Uploads over multipartThreshold bytes are written as multipart uploads of
+	// multipartPartSize parts, multipartConcurrency at a time (see putUpload).
+	multipartThreshold   int64
+	multipartPartSize    int64
+	multipartConcurrency int
+	// maxImageDim caps the longest side of an uploaded image (MAX_IMAGE_DIMENSION); larger
+	// ones are scaled down or rejected per oversizeMode (IMAGE_OVERSIZE). 0 disables it.
+	maxImageDim  int
+	oversizeMode string
+	// maxGIFFrames (MAX_GIF_FRAMES) and maxGIFPixels (MAX_GIF_PIXELS) cap GIF uploads; see
+	// checkGIF. 0 disables either.
+	maxGIFFrames int
+	maxGIFPixels int64
+	// thumbMaxDim is the longest side of generated thumbnails; 0 disables them.
+	thumbMaxDim int
+	// renditionSizes are the resized copies made of each uploaded image (RENDITION_SIZES),
+	// ascending; /feed?size= picks among them.
+	renditionSizes []int
+	// transcodeFormats are the formats uploads are also stored in (TRANSCODE_FORMATS) for
+	// /img/{key}; empty disables transcoding.
+	transcodeFormats []string
+	// objectCacheControl is the Cache-Control stored with uploads (OBJECT_CACHE_CONTROL) and
+	// objectDisposition their Content-Disposition type (CONTENT_DISPOSITION); see cacheControl.
+	objectCacheControl string
+	objectDisposition  string
+	// exifStrip is the EXIF_STRIP mode: which metadata is removed from JPEG uploads.
+	exifStrip string
+	// uploads holds keys reserved by /upload/presign until they're confirmed.
+	uploads uploadReservations
+	// resumable holds resumable uploads in progress (see resumableUpload).
+	resumable resumableUploads
+
+	// feedByKey: S3 key -> full URL; used to know if we already have a key when listing again.
+	feedByKey map[string]string
+	// feedMeta: S3 key -> user metadata (lowercased names).
+	feedMeta map[string]map[string]string
+	// feedByID: photo ID (see photoID) -> S3 key, kept in step with feedByKey.
+	feedByID map[string]string
+	// feedStat: S3 key -> last-modified time and size, as listed or uploaded.
+	feedStat    map[string]objectStat
+	feedByKeyMu sync.RWMutex
+	// nonMedia: bucket -> key -> version (see objectVersion) of extensionless objects a HEAD
+	// found not to be media, so a refresh only HEADs them again once they change. See
+	// isMediaKey.
+	nonMedia   map[string]map[string]string
+	nonMediaMu sync.Mutex
+	// feedCache is feedByKey materialized as a list for feedPool; nil until rebuilt after a
+	// change. See feedList.
+	feedCache atomic.Pointer[[]feedEntry]
+	// pinned lists the keys every /feed batch starts with, in pin order (see loadPinned).
+	pinned atomic.Pointer[[]string]
+	// photos holds each photo's record from the photos table (see loadPhotos).
+	photos atomic.Pointer[map[string]photoRecord]
+	// photoVotes holds each photo's vote counts by cat (see loadPhotoVotes).
+	photoVotes atomic.Pointer[map[string]map[string]int64]
+	// feedIndex shares the index with other instances (FEED_INDEX_STORE=redis); nil otherwise.
+	feedIndex feedIndexStore
+
+	// requestSeen: seen key -> photo keys we've already returned to that key. The seen key is the
+	// client key (query param), or "key\x00device" when the optional device param is given, so each
+	// device under one client key gets its own rotation. See seenKey.
+	requestSeen seenStore
+	// requestPending: seen key -> batch served in ack mode (/feed?ack=1) but not yet acknowledged.
+	// The same batch is returned until each URL is confirmed via POST /feed/ack, which marks it
+	// seen. Ack mode is at-least-once (a crash before ack re-serves the image) whereas the
+	// default mode is at-most-once (an image is consumed as soon as it is served).
+	requestPending map[string][]string
+	// rng drives feed selection. rand.Rand isn't safe for concurrent use, so it is only
+	// used with requestSeenMu held. Tests can replace it with a fixed-seed source.
+	rng *rand.Rand
+	// clientLRU orders seen keys by last use (front is newest) so the oldest can be evicted
+	// once more than maxTrackedClients are tracked (0 means unlimited) and idle ones expired.
+	// requestSeenMu guards requestPending, rng and the LRU; requestSeen does its own locking.
+	clientLRU         *list.List
+	clientLRUIndex    map[string]*list.Element
+	maxTrackedClients int
+	requestSeenMu     sync.Mutex
+	// seenExpired counts clients dropped by the idle janitor (SEEN_IDLE_TTL_SEC).
+	seenExpired atomic.Int64
+
+	// serves counts serves per photo for fair rotation (FAIR_ROTATION); nil when it's off.
+	serves *serveCounter
+	// views counts /feed serves per photo over time for /photos/trending.
+	views *viewCounter
+
+	feedLimiter *windowLimiter
+	// voteIPLimiter caps how many distinct client keys may vote from one IP per window.
+	voteIPLimiter *distinctLimiter
+	// uploadLimiter rate-limits uploads per client key, or per IP without one.
+	uploadLimiter *tokenLimiter
+	// idempotencyTTL is how long Idempotency-Key responses are kept (IDEMPOTENCY_TTL_SEC).
+	idempotencyTTL time.Duration
+	// reindexGroup makes concurrent reindex (and EXIF backfill) calls share a single run.
+	reindexGroup singleflight.Group
+
+	// maintenance freezes writes (/upload, /vote) while reads keep working. It starts from
+	// MAINTENANCE_MODE and can be flipped at runtime via POST /admin/maintenance.
+	maintenance atomic.Bool
+
+	// widgetFrameAncestors is the CSP frame-ancestors list for /widget (WIDGET_FRAME_ANCESTORS),
+	// i.e. which sites may embed it; "*" allows any.
+	widgetFrameAncestors string
+
+	// potd caches today's /potd pick.
+	potd potdCache
+
+	// events broadcasts live updates (new photos, consensus changes) to /feed/stream and /ws.
+	events *eventHub
+	// webhooks posts new photos to WEBHOOK_URLS; nil when none are set.
+	webhooks *webhookSender
+}
+
+// newServer returns a server with empty feed state and a time-seeded RNG.
+func newServer(db *sql.DB, s3Client *s3.Client, bucket string) *server {
+	return &server{
+		db:             db,
+		s3Client:       s3Client,
+		bucket:         bucket,
+		feedByKey:      make(map[string]string),
+		feedMeta:       make(map[string]map[string]string),
+		feedByID:       make(map[string]string),
+		feedStat:       make(map[string]objectStat),
+		nonMedia:       make(map[string]map[string]string),
+		requestSeen:    newMemorySeenStore(),
+		requestPending: make(map[string][]string),
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		clientLRU:      list.New(),
+		clientLRUIndex: make(map[string]*list.Element),
+		events:         newEventHub(),
+	}
+}
+
+// routes registers every endpoint on a new mux.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/feed", s.handleFeed)
+	mux.HandleFunc("/feed/ack", s.handleFeedAck)
+	mux.HandleFunc("/feed/peek", s.handleFeedPeek)
+	mux.HandleFunc("/feed/reset", s.handleFeedReset)
+	mux.HandleFunc("/feed/stream", s.handleFeedStream)
+	mux.HandleFunc("/ws", s.handleWS)
+	mux.HandleFunc("/potd", s.handlePOTD)
+	mux.HandleFunc("/pair", s.handlePair)
+	mux.HandleFunc("/oembed", s.handleOEmbed)
+	mux.HandleFunc("/widget", s.handleWidget)
+	mux.HandleFunc("/albums", s.handleAlbums)
+	mux.HandleFunc("/photos/trending", s.handleTrending)
+	mux.HandleFunc("/photos/", s.handlePhoto)
+	mux.HandleFunc("/feed.rss", s.handleFeedRSS)
+	mux.HandleFunc("/feed.atom", s.handleFeedAtom)
+	if s.imageProxy {
+		mux.HandleFunc("/image/", s.handleImage)
+	}
+	mux.HandleFunc("/img/", s.handleImg)
+	mux.HandleFunc("/upload", s.idempotent(s.handleUpload))
+	mux.HandleFunc("/upload-json", s.idempotent(s.handleUploadJSON))
+	mux.HandleFunc("/upload/url", s.handleUploadURL)
+	mux.HandleFunc("/upload/presign", s.handleUploadPresign)
+	mux.HandleFunc("/upload/confirm", s.handleUploadConfirm)
+	mux.HandleFunc("/upload/resumable", s.handleResumableCreate)
+	mux.HandleFunc(resumablePrefix, s.handleResumable)
+	mux.HandleFunc("/vote", s.idempotent(s.handleVote))
+	mux.HandleFunc("/vote/", s.handleVoteByKey)
+	mux.HandleFunc("/votes/", s.handleVotes)
+	mux.HandleFunc("/consensus", s.handleConsensus)
+	mux.HandleFunc("/consensus/export", s.handleConsensusExport)
+	mux.HandleFunc("/consensus/history", s.handleConsensusHistory)
+	mux.HandleFunc("/admin/reindex", s.handleReindex)
+	mux.HandleFunc("/admin/delete-batch", s.handleDeleteBatch)
+	mux.HandleFunc("/admin/merge-photos", s.handleMergePhotos)
+	mux.HandleFunc("/admin/vote-reasons", s.handleVoteReasons)
+	mux.HandleFunc("/admin/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/admin/photos/delete", s.handleDeleteBatch)
+	mux.HandleFunc("/admin/pending", s.handlePending)
+	mux.HandleFunc("/admin/quarantine", s.handleQuarantine)
+	mux.HandleFunc("/admin/quarantine/", s.handleQuarantine)
+	mux.HandleFunc("/admin/photos/", s.handlePhotoAdmin)
+	mux.HandleFunc("/admin/cache/invalidate", s.handleCacheInvalidate)
+	mux.HandleFunc("/admin/backfill-exif", s.handleBackfillExif)
+	return mux
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// tunables are the settings that can change at runtime via SIGHUP. Credentials and anything
+// wired up once at startup (DB, R2, TLS, ports, proxy mode) are deliberately not included.
+type tunables struct {
+	FeedDefaultLimit    int
+	FeedRateLimitPerMin int // 0 disables the per-key /feed limit
+	VoteIPMaxKeys       int // 0 disables the distinct-keys-per-IP /vote limit
+	UploadRatePerMin    int // 0 disables the per-client upload limit
+	UploadBurst         int
+	SlowRequest         time.Duration
+	URLSigningTTL       time.Duration
+}
+
+// reloadableEnv is the whitelist of variables a SIGHUP may change.
+var reloadableEnv = []string{
+	"FEED_DEFAULT_LIMIT",
+	"FEED_RATE_LIMIT_PER_MIN",
+	"VOTE_IP_MAX_KEYS",
+	"UPLOAD_RATE_LIMIT_PER_MIN",
+	"UPLOAD_RATE_BURST",
+	"SLOW_REQUEST_MS",
+	"URL_SIGNING_TTL_SEC",
+}
+
+var settings atomic.Pointer[tunables]
+
+// currentTunables returns the active settings; handlers should call it per request.
+func currentTunables() *tunables {
+	return settings.Load()
+}
+
+func loadTunables() *tunables {
+	return &tunables{
+		FeedDefaultLimit:    envInt("FEED_DEFAULT_LIMIT", 5),
+		FeedRateLimitPerMin: envInt("FEED_RATE_LIMIT_PER_MIN", 60),
+		VoteIPMaxKeys:       envInt("VOTE_IP_MAX_KEYS", 0),
+		UploadRatePerMin:    envInt("UPLOAD_RATE_LIMIT_PER_MIN", 10),
+		UploadBurst:         envInt("UPLOAD_RATE_BURST", 5),
+		SlowRequest:         time.Duration(envInt("SLOW_REQUEST_MS", 1000)) * time.Millisecond,
+		URLSigningTTL:       time.Duration(envInt("URL_SIGNING_TTL_SEC", 3600)) * time.Second,
+	}
+}
+
+// watchReload re-reads the whitelisted variables from path on every SIGHUP, swaps in the new
+// settings and calls onReload with them. Variables absent from the file keep their current value.
+func watchReload(path string, onReload func(*tunables)) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			vals, err := godotenv.Read(path)
+			if err != nil {
+				log.Printf("reload: read %s: %v", path, err)
+				continue
+			}
+			for _, name := range reloadableEnv {
+				if v, ok := vals[name]; ok {
+					os.Setenv(name, v)
+				}
+			}
+			t := loadTunables()
+			settings.Store(t)
+			onReload(t)
+			log.Printf("reload: applied settings from %s: %+v", path, *t)
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// feedSnapshot is the on-disk form of the feed index. URLs aren't stored since they depend on
+// the current feedURLBase; they're rebuilt from the keys on load.
+type feedSnapshot struct {
+	SavedAt time.Time                 `json:"saved_at"`
+	Bucket  string                    `json:"bucket"`
+	Objects map[string]snapshotObject `json:"objects"`
+}
+
+type snapshotObject struct {
+	Modified    time.Time         `json:"modified"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Thumb       bool              `json:"thumb,omitempty"`
+	Renditions  []int             `json:"renditions,omitempty"`
+	Formats     []string          `json:"formats,omitempty"`
+	Bucket      string            `json:"bucket,omitempty"`
+	TakenAt     time.Time         `json:"taken_at,omitempty"`
+	Animated    bool              `json:"animated,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+func newSnapshotObject(st objectStat, meta map[string]string) snapshotObject {
+	return snapshotObject{
+		Modified:    st.modified,
+		Size:        st.size,
+		ContentType: st.contentType,
+		Width:       st.width,
+		Height:      st.height,
+		Thumb:       st.thumb,
+		Renditions:  st.renditions,
+		Formats:     st.formats,
+		Bucket:      st.bucket,
+		TakenAt:     st.takenAt,
+		Animated:    st.animated,
+		Meta:        meta,
+	}
+}
+
+// saveSnapshot writes the feed index to path, via a temp file so a crash mid-write never
+// leaves a truncated snapshot behind.
+func (s *server) saveSnapshot(path string) error {
+	snap := feedSnapshot{SavedAt: time.Now(), Bucket: s.bucket, Objects: s.feedObjects()}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot replaces the feed index with the snapshot at path. It fails if the file is
+// missing, unreadable, for another bucket or older than maxAge (0 means any age).
+func (s *server) loadSnapshot(path string, maxAge time.Duration) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var snap feedSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("corrupt snapshot: %w", err)
+	}
+	if snap.Bucket != s.bucket {
+		return 0, fmt.Errorf("snapshot is for bucket %q", snap.Bucket)
+	}
+	if maxAge > 0 && time.Since(snap.SavedAt) > maxAge {
+		return 0, fmt.Errorf("snapshot is stale (saved %s)", snap.SavedAt.Format(time.RFC3339))
+	}
+	if snap.Objects == nil {
+		return 0, errors.New("snapshot has no objects")
+	}
+	s.setFeedObjects(snap.Objects)
+	return len(snap.Objects), nil
+}
+
+// feedObjects returns a copy of the feed index in its serialized form.
+func (s *server) feedObjects() map[string]snapshotObject {
+	s.feedByKeyMu.RLock()
+	defer s.feedByKeyMu.RUnlock()
+	objs := make(map[string]snapshotObject, len(s.feedByKey))
+	for k := range s.feedByKey {
+		objs[k] = newSnapshotObject(s.feedStat[k], s.feedMeta[k])
+	}
+	return objs
+}
+
+// setFeedObjects replaces the feed index with objs.
+func (s *server) setFeedObjects(objs map[string]snapshotObject) {
+	byKey := make(map[string]string, len(objs))
+	meta := make(map[string]map[string]string)
+	stats := make(map[string]objectStat, len(objs))
+	for k, o := range objs {
+		byKey[k] = s.bucketURL(o.Bucket, k)
+		stats[k] = objectStat{modified: o.Modified, size: o.Size, contentType: o.ContentType, width: o.Width, height: o.Height, thumb: o.Thumb, renditions: o.Renditions, formats: o.Formats, bucket: o.Bucket, takenAt: o.TakenAt, animated: o.Animated}
+		if len(o.Meta) > 0 {
+			meta[k] = o.Meta
+		}
+	}
+	s.feedByKeyMu.Lock()
+	s.feedByKey = byKey
+	s.feedByID = idIndex(byKey)
+	s.feedMeta = meta
+	s.feedStat = stats
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+}
+
+// runSnapshots saves the feed index to path every interval.
+func (s *server) runSnapshots(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.saveSnapshot(path); err != nil {
+			log.Printf("feed snapshot save: %v", err)
+		}
+	}
+}
+
+// reconcileFromBucket re-lists the bucket after a snapshot load and saves a fresh snapshot.
+func (s *server) reconcileFromBucket(path string) {
+	start := time.Now()
+	n, err := s.rebuildFeed(context.Background())
+	if err != nil {
+		log.Printf("feed reconcile after snapshot load: %v", err)
+		return
+	}
+	log.Printf("feed reconciled with bucket: count=%d duration=%s", n, time.Since(start))
+	if err := s.saveSnapshot(path); err != nil {
+		log.Printf("feed snapshot save: %v", err)
+	}
+}
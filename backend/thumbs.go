@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// thumbPrefix holds generated thumbnails. Objects under it are never feed items themselves.
+const thumbPrefix = "thumbs/"
+
+const thumbJPEGQuality = 80
+
+// thumbKey is where the thumbnail for key is stored. Thumbnails are always JPEG whatever the
+// original's extension.
+func thumbKey(key string) string {
+	return thumbPrefix + key
+}
+
+func isThumbKey(key string) bool {
+	return strings.HasPrefix(key, thumbPrefix)
+}
+
+// isDerivedKey reports whether key is a thumbnail, rendition or transcoded copy rather than
+// a photo.
+func isDerivedKey(key string) bool {
+	return isThumbKey(key) || isRenditionKey(key) || isFormatKey(key)
+}
+
+// derivedObjects is what a bucket listing says about each photo's derived objects.
+type derivedObjects struct {
+	thumbs     map[string]bool     // keys with a thumbnail
+	renditions map[string][]int    // rendition sizes by key, ascending
+	formats    map[string][]string // transcoded formats by key
+}
+
+// splitDerived separates derived objects (see isDerivedKey) out of a bucket listing,
+// returning the rest and what was found.
+func splitDerived(objects []types.Object) ([]types.Object, derivedObjects) {
+	photos := make([]types.Object, 0, len(objects))
+	d := derivedObjects{thumbs: make(map[string]bool), renditions: make(map[string][]int), formats: make(map[string][]string)}
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		switch {
+		case isThumbKey(key):
+			d.thumbs[strings.TrimPrefix(key, thumbPrefix)] = true
+		case isRenditionKey(key):
+			if k, size, ok := parseRenditionKey(key); ok {
+				d.renditions[k] = append(d.renditions[k], size)
+			}
+		case isFormatKey(key):
+			if k, format, ok := parseFormatKey(key); ok {
+				d.formats[k] = append(d.formats[k], format)
+			}
+		case isQuarantineKey(key), isIncomingKey(key):
+			// Held back by moderation, or a direct upload not yet confirmed; neither a photo
+			// nor derived from one.
+		default:
+			photos = append(photos, obj)
+		}
+	}
+	for _, sizes := range d.renditions {
+		slices.Sort(sizes)
+	}
+	return photos, d
+}
+
+// deleteThumbnails removes the derived objects of deleted photos. Deleting a missing key
+// succeeds, so photos without them need no special case; failures only orphan an object and
+// are logged.
+func (s *server) deleteThumbnails(ctx context.Context, keys []string) {
+	var thumbs []string
+	for _, k := range keys {
+		thumbs = append(thumbs, thumbKey(k))
+		for _, size := range s.renditionSizes {
+			thumbs = append(thumbs, renditionKey(k, size))
+		}
+		for _, f := range imageFormats {
+			thumbs = append(thumbs, formatKey(k, f.name))
+		}
+	}
+	if len(thumbs) == 0 {
+		return
+	}
+	for _, res := range s.deleteKeys(ctx, thumbs) {
+		if res.Error != "" {
+			log.Printf("thumbnail delete: key=%s err=%s", res.Key, res.Error)
+		}
+	}
+}
+
+// storeThumbnail writes a thumbnail for key no larger than maxDim on either side and rewinds
+// body. It reports whether one was stored; failures are logged and leave the upload without
+// a thumbnail rather than failing it.
+func (s *server) storeThumbnail(ctx context.Context, key string, body io.ReadSeeker, maxDim int) bool {
+	if maxDim <= 0 {
+		return false
+	}
+	src, ok := decodeImage(body)
+	return ok && s.putJPEG(ctx, thumbKey(key), scaleDown(src, maxDim))
+}
+
+// storeImageDerivatives writes the thumbnail and renditions of an uploaded image, decoding
+// it once, and rewinds body. Like storeThumbnail, failures only leave them missing.
+func (s *server) storeImageDerivatives(ctx context.Context, key string, body io.ReadSeeker) (thumb bool, renditions []int) {
+	if s.thumbMaxDim <= 0 && len(s.renditionSizes) == 0 {
+		return false, nil
+	}
+	src, ok := decodeImage(body)
+	if !ok {
+		return false, nil
+	}
+	thumb = s.thumbMaxDim > 0 && s.putJPEG(ctx, thumbKey(key), scaleDown(src, s.thumbMaxDim))
+	return thumb, s.storeRenditions(ctx, key, src)
+}
+
+// decodeImage decodes body and rewinds it.
+func decodeImage(body io.ReadSeeker) (image.Image, bool) {
+	src, _, err := image.Decode(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return nil, false
+	}
+	return src, true
+}
+
+// putJPEG encodes img and stores it at objKey in the primary bucket with the upload's ACL,
+// logging failures.
+func (s *server) putJPEG(ctx context.Context, objKey string, img image.Image) bool {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbJPEGQuality}); err != nil {
+		log.Printf("derived image encode: key=%s err=%v", objKey, err)
+		return false
+	}
+	_, err := s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(objKey),
+		Body:         bytes.NewReader(buf.Bytes()),
+		ContentType:  aws.String("image/jpeg"),
+		CacheControl: s.cacheControl(),
+		ACL:          s.uploadACL(),
+	})
+	if err != nil {
+		log.Printf("derived image upload: key=%s err=%v", objKey, err)
+		return false
+	}
+	return true
+}
+
+// scaleDown box-filters src so neither side exceeds maxDim, keeping the aspect ratio. Images
+// already small enough are returned as is.
+func scaleDown(src image.Image, maxDim int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= maxDim && sh <= maxDim {
+		return src
+	}
+	dw, dh := maxDim, sh*maxDim/sw
+	if sh > sw {
+		dw, dh = sw*maxDim/sh, maxDim
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// formatPrefix holds transcoded copies of photos at formats/{format}/{key}. The original is
+// always kept; /img/{key} picks among them.
+const formatPrefix = "formats/"
+
+// transcodeTimeout bounds one encoder run; AVIF in particular is slow on large photos.
+const transcodeTimeout = 2 * time.Minute
+
+// imageFormat is a format uploads can be transcoded to, by an external encoder since the
+// standard library can't write either.
+type imageFormat struct {
+	name        string
+	contentType string
+	// command is the encoder invocation reading in and writing out.
+	command func(in, out string) (string, []string)
+}
+
+// imageFormats lists the supported formats in order of preference for negotiation.
+var imageFormats = []imageFormat{
+	{"avif", "image/avif", func(in, out string) (string, []string) {
+		return envOr("AVIFENC_PATH", "avifenc"), []string{"--speed", "8", "-q", "60", in, out}
+	}},
+	{"webp", "image/webp", func(in, out string) (string, []string) {
+		return envOr("CWEBP_PATH", "cwebp"), []string{"-quiet", "-q", "80", "-metadata", "none", in, "-o", out}
+	}},
+}
+
+func formatKey(key, format string) string {
+	return formatPrefix + format + "/" + key
+}
+
+func isFormatKey(key string) bool {
+	return strings.HasPrefix(key, formatPrefix)
+}
+
+// parseFormatKey splits a transcoded copy's key into the photo key and format.
+func parseFormatKey(k string) (key, format string, ok bool) {
+	format, key, ok = strings.Cut(strings.TrimPrefix(k, formatPrefix), "/")
+	if !ok || key == "" || !slices.ContainsFunc(imageFormats, func(f imageFormat) bool { return f.name == format }) {
+		return "", "", false
+	}
+	return key, format, true
+}
+
+// parseTranscodeFormats reads TRANSCODE_FORMATS (e.g. "webp,avif"), rejecting unknown names.
+func parseTranscodeFormats(v string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.ContainsFunc(imageFormats, func(f imageFormat) bool { return f.name == name }) {
+			return nil, fmt.Errorf("unknown format %q", name)
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
+
+// transcodeUpload writes the configured transcoded copies of an uploaded image in the
+// background, adding each format to the index as it lands. body is read (and rewound) before
+// returning. Only JPEG and PNG are transcoded; GIFs may be animated and WebP is already
+// compact.
+func (s *server) transcodeUpload(key, contentType string, body io.ReadSeeker) {
+	if len(s.transcodeFormats) == 0 || (contentType != "image/jpeg" && contentType != "image/png") {
+		return
+	}
+	data, err := io.ReadAll(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		log.Printf("transcode read: key=%s err=%v", key, errors.Join(err, serr))
+		return
+	}
+	go func() {
+		ctx := context.Background()
+		for _, f := range imageFormats {
+			if !slices.Contains(s.transcodeFormats, f.name) {
+				continue
+			}
+			if err := s.storeFormat(ctx, key, contentType, data, f); err != nil {
+				log.Printf("transcode: key=%s format=%s err=%v", key, f.name, err)
+				continue
+			}
+			s.feedByKeyMu.Lock()
+			st, ok := s.feedStat[key]
+			if ok {
+				st.formats = append(slices.Clip(st.formats), f.name)
+				s.feedStat[key] = st
+				s.invalidateFeedCache()
+			}
+			meta := s.feedMeta[key]
+			s.feedByKeyMu.Unlock()
+			if ok {
+				s.shareFeedObject(ctx, key, newSnapshotObject(st, meta))
+			}
+		}
+	}()
+}
+
+// storeFormat encodes data as f via temp files and uploads the result.
+func (s *server) storeFormat(ctx context.Context, key, contentType string, data []byte, f imageFormat) error {
+	dir, err := os.MkdirTemp("", "transcode-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	in, out := filepath.Join(dir, "in"+ext), filepath.Join(dir, "out."+f.name)
+	if err := os.WriteFile(in, data, 0o600); err != nil {
+		return err
+	}
+	name, args := f.command(in, out)
+	if err := runTool(ctx, name, args...); err != nil {
+		return err
+	}
+	encoded, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(formatKey(key, f.name)),
+		Body:         bytes.NewReader(encoded),
+		ContentType:  aws.String(f.contentType),
+		CacheControl: s.cacheControl(),
+		ACL:          s.uploadACL(),
+	})
+	return err
+}
+
+// runTool runs an external image tool with transcodeTimeout, folding its output into the
+// error when it fails.
+func runTool(ctx context.Context, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, transcodeTimeout)
+	defer cancel()
+	if msg, err := exec.CommandContext(ctx, name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// handleImg serves /img/{key}: the photo in the best format the client takes. format=avif,
+// webp or original picks one explicitly; otherwise the Accept header is matched against the
+// transcoded copies, in imageFormats order. Formats a photo lacks fall back to the original.
+// Tokens are checked as for /image/ when signing is enabled.
+func (s *server) handleImg(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/img/")
+	want := r.URL.Query().Get("format")
+	if want != "" && want != "original" && !slices.ContainsFunc(imageFormats, func(f imageFormat) bool { return f.name == want }) {
+		handleError(w, newError(ErrValidation, "format must be avif, webp or original"))
+		return
+	}
+	if s.signer != nil {
+		if err := s.signer.verify(key, r.URL.Query()); err != nil {
+			handleError(w, err)
+			return
+		}
+	}
+	s.feedByKeyMu.RLock()
+	_, ok := s.feedByKey[key]
+	formats := s.feedStat[key].formats
+	s.feedByKeyMu.RUnlock()
+	if !ok {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+
+	objKey := key
+	if want == "" {
+		w.Header().Add("Vary", "Accept")
+		accept := r.Header.Get("Accept")
+		for _, f := range imageFormats {
+			if slices.Contains(formats, f.name) && strings.Contains(accept, f.contentType) {
+				objKey = formatKey(key, f.name)
+				break
+			}
+		}
+	} else if slices.Contains(formats, want) {
+		objKey = formatKey(key, want)
+	}
+	s.streamObject(w, r, objKey)
+}
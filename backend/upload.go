@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var errUploadTooLarge = newError(ErrTooLarge, "image too large")
+
+func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	if !requireUploadToken(w, r) {
+		return
+	}
+	if !s.allowUpload(w, r) {
+		return
+	}
+
+	// Leave room for a poster and the other form fields.
+	s.limitUploadBody(w, r, maxUploadFormFields)
+	form, err := s.readUploadForm(r)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if form.image == nil {
+		handleError(w, newError(ErrValidation, "missing or invalid form field 'image'"))
+		return
+	}
+	meta, err := parseUploadMetadata(form.values)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	album, err := parseAlbum(form.value(r, "album"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	details, err := parsePhotoDetails(form.value(r, "caption"), form.value(r, catMetaName), form.value(r, "uploaded_by"))
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	up := upload{
+		filename:    form.image.filename,
+		contentType: form.image.contentType,
+		body:        bytes.NewReader(form.image.data),
+		size:        int64(len(form.image.data)),
+		meta:        meta,
+		details:     details,
+		album:       album,
+	}
+	// Videos can carry a poster image; it's stored as the video's thumbnail.
+	if form.poster != nil {
+		up.poster = bytes.NewReader(form.poster.data)
+	}
+	s.storeUpload(r.Context(), w, up)
+}
+
+// uploadJSONRequest is the body of POST /upload-json.
+type uploadJSONRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        string `json:"data"`        // standard base64
+	Cat         string `json:"cat"`         // optional cat tag, as for /upload
+	Caption     string `json:"caption"`     // optional, as for /upload
+	UploadedBy  string `json:"uploaded_by"` // optional, as for /upload
+	Poster      string `json:"poster"`      // optional base64 poster image for a video
+	Album       string `json:"album"`       // optional album, as for /upload
+}
+
+// handleUploadJSON accepts an image as base64 in a JSON body for clients that can't easily
+// send multipart, then stores it exactly like /upload.
+func (s *server) handleUploadJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	if !requireUploadToken(w, r) {
+		return
+	}
+	if !s.allowUpload(w, r) {
+		return
+	}
+
+	// Base64 inflates by 4/3; leave room for a poster and the other fields.
+	limit := max(s.maxUploadBytes, s.maxVideoUploadBytes) + s.maxUploadBytes
+	s.limitUploadBody(w, r, int64(base64.StdEncoding.EncodedLen(int(limit)))-limit+4096)
+	var req uploadJSONRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			handleError(w, errUploadTooLarge)
+			return
+		}
+		handleError(w, newError(ErrValidation, "invalid JSON body"))
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "data is not valid base64"))
+		return
+	}
+	details, err := parsePhotoDetails(req.Caption, req.Cat, req.UploadedBy)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	album, err := parseAlbum(req.Album)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	up := upload{
+		filename:    req.Filename,
+		contentType: req.ContentType,
+		body:        bytes.NewReader(data),
+		size:        int64(len(data)),
+		details:     details,
+		album:       album,
+	}
+	if details.cat != "" {
+		up.meta = map[string]string{catMetaName: details.cat}
+	}
+	if req.Poster != "" {
+		p, err := base64.StdEncoding.DecodeString(req.Poster)
+		if err != nil {
+			handleError(w, newError(ErrValidation, "poster is not valid base64"))
+			return
+		}
+		up.poster = bytes.NewReader(p)
+	}
+	s.storeUpload(r.Context(), w, up)
+}
+
+// allowUpload applies the per-client upload rate limit, writing a 429 when it's exceeded.
+// Clients are told apart by the key query param, as for /feed, or else by IP.
+func (s *server) allowUpload(w http.ResponseWriter, r *http.Request) bool {
+	client := "ip:" + clientIP(r)
+	if k := r.URL.Query().Get("key"); k != "" {
+		client = "key:" + k
+	}
+	if allowed, retry := s.uploadLimiter.allow(client); !allowed {
+		handleError(w, retryError(ErrRateLimited, "upload rate limit exceeded", retry))
+		return false
+	}
+	return true
+}
+
+// limitUploadBody caps an upload request body at the largest file it may carry, a video
+// plus its poster, and extra bytes of encoding and form overhead. Reads past it fail with
+// http.MaxBytesError, which handlers answer with a 413.
+func (s *server) limitUploadBody(w http.ResponseWriter, r *http.Request, extra int64) {
+	s.setUploadLimitHeaders(w)
+	r.Body = http.MaxBytesReader(w, r.Body, max(s.maxUploadBytes, s.maxVideoUploadBytes)+s.maxUploadBytes+extra)
+}
+
+// setUploadLimitHeaders advertises the upload size limits (MAX_UPLOAD_BYTES and
+// MAX_VIDEO_UPLOAD_BYTES) on every upload endpoint's response, so clients can check before
+// sending.
+func (s *server) setUploadLimitHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Max-Upload-Bytes", strconv.FormatInt(s.maxUploadBytes, 10))
+	w.Header().Set("X-Max-Video-Upload-Bytes", strconv.FormatInt(s.maxVideoUploadBytes, 10))
+}
+
+// upload is one file to store, as parsed by either upload endpoint.
+type upload struct {
+	key         string // optional; the key reserved for it, else one is made from filename
+	filename    string
+	contentType string // as declared by the client; the stored type is sniffed from body
+	body        io.ReadSeeker
+	size        int64
+	meta        map[string]string
+	details     photoDetails
+	poster      io.ReadSeeker // optional; becomes a video's thumbnail
+	album       string        // optional; the key prefix (see parseAlbum)
+}
+
+// storeUpload is the pipeline shared by both upload endpoints: it validates the image or
+// video, writes it to R2, adds it to the feed and responds with the upload result. Images
+// get a generated thumbnail and renditions; videos use their poster, if any.
+func (s *server) storeUpload(ctx context.Context, w http.ResponseWriter, up upload) {
+	filename, contentType, body, size, meta := up.filename, up.contentType, up.body, up.size, up.meta
+	if size == 0 {
+		handleError(w, newError(ErrUnprocessable, "empty file"))
+		return
+	}
+	// The declared type is only a hint; what's stored is what the bytes say.
+	sniffed, err := sniffContentType(body)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "could not read image"))
+		return
+	}
+	if err := checkUploadType(sniffed); err != nil {
+		handleError(w, err)
+		return
+	}
+	if contentType != "" && contentType != sniffed {
+		log.Printf("upload content type mismatch: filename=%s declared=%s detected=%s", filename, contentType, sniffed)
+	}
+	contentType = sniffed
+	isVideo := mediaKind(contentType) == "video"
+	if (isVideo && size > s.maxVideoUploadBytes) || (!isVideo && size > s.maxUploadBytes) {
+		handleError(w, errUploadTooLarge)
+		return
+	}
+	// Duplicates are spotted by the file as sent, before any conversion. A failed lookup
+	// only means the upload is stored again.
+	hash, err := hashUpload(body)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "could not read image"))
+		return
+	}
+	if dup, ok, err := s.duplicateUpload(ctx, hash); err != nil {
+		log.Printf("upload hash lookup: filename=%s err=%v", filename, err)
+	} else if ok {
+		log.Printf("duplicate upload: filename=%s key=%s", filename, dup)
+		s.feedByKeyMu.RLock()
+		st, indexed := s.feedStat[dup]
+		s.feedByKeyMu.RUnlock()
+		resp := map[string]interface{}{"key": dup}
+		if indexed {
+			resp = s.uploadResponse(dup, st)
+		}
+		resp["duplicate"] = true
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if contentType == "image/heic" {
+		data, err := io.ReadAll(body)
+		if err == nil {
+			data, err = convertHEIC(ctx, data)
+		}
+		if err != nil {
+			log.Printf("heic convert: filename=%s err=%v", filename, err)
+			handleError(w, newError(ErrUnprocessable, "could not convert HEIC image"))
+			return
+		}
+		filename, contentType, body, size = jpegFilename(filename), "image/jpeg", bytes.NewReader(data), int64(len(data))
+	}
+
+	key := up.key
+	if key == "" {
+		key = s.uploadKey(filename, up.album)
+	}
+	log.Printf("new file received: filename=%s key=%s", filename, key)
+
+	// Dimensions and capture time are stored as object metadata too, so the metadata sync
+	// can recover them. Capture time is read first: applying the orientation re-encodes the
+	// photo without its EXIF.
+	takenAt, _ := exifTakenAt(body)
+	body, size, err = orientUpload(body, size, contentType)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "could not read image"))
+		return
+	}
+	if body, size, err = s.limitDimensions(body, size, contentType); err != nil {
+		handleError(w, err)
+		return
+	}
+	animated, err := s.checkGIF(body, contentType)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	width, height := imageDimensions(body)
+	objectMeta := make(map[string]string, len(meta)+4)
+	for k, v := range meta {
+		objectMeta[k] = v
+	}
+	if width > 0 {
+		objectMeta[widthMetaName] = strconv.Itoa(width)
+		objectMeta[heightMetaName] = strconv.Itoa(height)
+	}
+	if !takenAt.IsZero() {
+		objectMeta[takenAtMetaName] = takenAt.Format(time.RFC3339)
+	}
+	if animated {
+		objectMeta[animatedMetaName] = "true"
+	}
+	body, size, err = s.stripUpload(body, size, contentType)
+	if err != nil {
+		handleError(w, newError(ErrValidation, "could not read image"))
+		return
+	}
+
+	if err := s.scanUpload(ctx, key, body); err != nil {
+		handleError(w, err)
+		return
+	}
+	// Moderated before the write, so a rejected image is never public.
+	quarantined, err := s.moderateUpload(ctx, key, contentType, body, objectMeta)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if quarantined {
+		// The record keeps the upload's details in case an admin releases it.
+		stat := objectStat{modified: time.Now(), size: size, contentType: contentType, width: width, height: height, takenAt: takenAt, animated: animated}
+		if err := s.recordPhoto(ctx, key, stat, up.details, photoQuarantined); err != nil {
+			log.Printf("photo record: key=%s err=%v", key, err)
+		}
+		writeQuarantined(w, key)
+		return
+	}
+	versionID, err := s.putUpload(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(s.bucket),
+		Key:                aws.String(key),
+		Body:               body,
+		ContentType:        aws.String(contentType),
+		CacheControl:       s.cacheControl(),
+		ContentDisposition: s.contentDisposition(filename, key),
+		ACL:                s.uploadACL(),
+		Metadata:           objectMeta,
+		IfNoneMatch:        s.uploadIfNoneMatch(),
+	}, size)
+	if isPreconditionFailed(err) {
+		handleError(w, errKeyExists)
+		return
+	}
+	if err != nil {
+		handleError(w, s.r2Error("upload failed", err))
+		return
+	}
+	// The write leaves body at its end; the derivatives read it again.
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		handleError(w, wrapError(ErrInternal, "upload failed", err))
+		return
+	}
+	stat := objectStat{modified: time.Now(), size: size, contentType: contentType, width: width, height: height, takenAt: takenAt, animated: animated}
+	if !isVideo {
+		stat.thumb, stat.renditions = s.storeImageDerivatives(ctx, key, body)
+		s.transcodeUpload(key, contentType, body)
+	} else if up.poster != nil {
+		if typ, err := sniffContentType(up.poster); err == nil && mediaKind(typ) == "image" {
+			stat.thumb = s.storeThumbnail(ctx, key, up.poster, s.thumbMaxDim)
+		}
+	}
+	pending, err := s.indexUpload(ctx, key, stat, meta, up.details)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	if err := s.recordUploadHash(ctx, hash, key); err != nil {
+		log.Printf("upload hash record: key=%s err=%v", key, err)
+	}
+	resp := s.uploadResponse(key, stat)
+	if up.filename != "" {
+		resp["filename"] = up.filename
+	}
+	// VersionId is only set when the bucket has versioning enabled.
+	if versionID != "" {
+		resp["version_id"] = versionID
+	}
+	log.Printf("successfully uploaded to R2: key=%s version=%s", key, versionID)
+	if pending {
+		writePending(w, resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// uploadResponse is the body for a stored upload: its URL, type, size, dimensions and the
+// URLs of its derived images, so a client can show it without asking again. URLs are signed
+// as /feed's are.
+func (s *server) uploadResponse(key string, stat objectStat) map[string]interface{} {
+	urls := []string{s.bucketURL(stat.bucket, key)}
+	if stat.thumb {
+		urls = append(urls, s.bucketURL(stat.bucket, thumbKey(key)))
+	}
+	for _, size := range stat.renditions {
+		urls = append(urls, s.bucketURL(stat.bucket, renditionKey(key, size)))
+	}
+	signed := s.signFeedURLs(urls)
+	resp := map[string]interface{}{
+		"key":          key,
+		"id":           photoID(key),
+		"url":          signed[0],
+		"content_type": stat.contentType,
+		"size":         stat.size,
+		"duplicate":    false,
+	}
+	if stat.width > 0 {
+		resp["width"], resp["height"] = stat.width, stat.height
+	}
+	if stat.animated {
+		resp["animated"] = true
+	}
+	signed = signed[1:]
+	if stat.thumb {
+		resp["thumb_url"], signed = signed[0], signed[1:]
+	}
+	if len(stat.renditions) > 0 {
+		renditions := make(map[string]string, len(signed))
+		for i, size := range stat.renditions {
+			renditions[strconv.Itoa(size)] = signed[i]
+		}
+		resp["renditions"] = renditions
+	}
+	return resp
+}
+
+// uploadKey is the bucket key for an uploaded file, under album if given. It's the file's
+// sanitized name behind a timestamp and random suffix, so two phones' IMG_0001.jpg don't
+// overwrite each other. With KEEP_UPLOAD_FILENAMES it's the base name as sent, or a
+// timestamped name when there's none.
+func (s *server) uploadKey(filename, album string) string {
+	var key string
+	if s.keepUploadFilenames {
+		key = filepath.Base(filename)
+		if key == "" || key == "." {
+			key = fmt.Sprintf("%s-%s.jpg", time.Now().Format("2006-01-02"), time.Now().Format("150405"))
+		}
+	} else {
+		key = fmt.Sprintf("%s-%08x-%s", time.Now().UTC().Format("20060102-150405"), rand.Uint32(), sanitizeFilename(filename))
+	}
+	if album != "" {
+		key = album + "/" + key
+	}
+	return key
+}
+
+// sanitizeFilename reduces a client's file name to letters, digits, dots, dashes and
+// underscores, runs of anything else becoming one dash, and at most 100 bytes.
+func sanitizeFilename(filename string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range filepath.Base(filename) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '_' || c == '-' {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	name := strings.Trim(b.String(), "-.")
+	if name == "" {
+		return "upload.jpg"
+	}
+	if len(name) > 100 {
+		ext := filepath.Ext(name)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		name = name[:100-len(ext)] + ext
+	}
+	return name
+}
+
+// indexUpload adds a freshly stored object to the feed, records its details, shares it with
+// other instances and announces it to live subscribers. With REQUIRE_APPROVAL it's held for
+// review instead and pending is true; if it can't be queued it's deleted rather than left
+// for a refresh to publish, and the error returned.
+func (s *server) indexUpload(ctx context.Context, key string, stat objectStat, meta map[string]string, details photoDetails) (pending bool, err error) {
+	status := photoPublished
+	if s.requireApproval {
+		status = photoPending
+	}
+	if err := s.recordPhoto(ctx, key, stat, details, status); err != nil {
+		log.Printf("photo record: key=%s err=%v", key, err)
+	}
+	if s.requireApproval {
+		if err := s.holdForApproval(ctx, key); err != nil {
+			s.deletePhotos(context.Background(), []string{key})
+			return false, wrapError(ErrInternal, "could not queue upload for approval", err)
+		}
+		return true, nil
+	}
+	s.feedByKeyMu.Lock()
+	s.setFeedKey(key, s.objectURL(key))
+	s.feedStat[key] = stat
+	if len(meta) > 0 {
+		s.feedMeta[key] = meta
+	} else {
+		delete(s.feedMeta, key)
+	}
+	s.invalidateFeedCache()
+	s.feedByKeyMu.Unlock()
+	s.shareFeedObject(ctx, key, newSnapshotObject(stat, meta))
+	s.publishPhotoAdded(key)
+	return false, nil
+}
+
+// imageDimensions decodes just the image header for its size and rewinds body. It returns
+// zeros for formats it can't decode.
+func imageDimensions(body io.ReadSeeker) (width, height int) {
+	cfg, _, err := image.DecodeConfig(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+// sniffContentType detects the type from the first 512 bytes (see detectMediaType) and
+// rewinds body.
+func sniffContentType(body io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(body, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detectMediaType(buf[:n]), nil
+}
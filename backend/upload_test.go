@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newUploadTestServer(t *testing.T) *server {
+	t.Helper()
+	t.Setenv("UPLOAD_TOKEN", "")
+	s := newServer(nil, nil, "")
+	s.uploadLimiter = newTokenLimiter(60, 10)
+	s.maxUploadBytes = 10 << 20
+	return s
+}
+
+// assertUnprocessable checks for the 422 an empty upload is rejected with.
+func assertUnprocessable(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if body["error"] != "empty file" {
+		t.Fatalf("error = %q, want %q", body["error"], "empty file")
+	}
+}
+
+func TestUploadRejectsEmptyFile(t *testing.T) {
+	s := newUploadTestServer(t)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if _, err := mw.CreateFormFile("image", "empty.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	assertUnprocessable(t, rec)
+}
+
+func TestUploadJSONRejectsEmptyData(t *testing.T) {
+	s := newUploadTestServer(t)
+	body := `{"filename": "empty.jpg", "content_type": "image/jpeg", "data": ""}`
+	req := httptest.NewRequest(http.MethodPost, "/upload-json", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	assertUnprocessable(t, rec)
+}
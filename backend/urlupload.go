@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+)
+
+const (
+	// urlFetchTimeout bounds fetching one remote image, redirects included.
+	urlFetchTimeout = 30 * time.Second
+	// urlFetchMaxRedirects is how many redirects a fetch follows.
+	urlFetchMaxRedirects = 5
+)
+
+var errPrivateAddress = errors.New("address is not public")
+
+// urlFetchClient fetches images for /upload/url. Its dialer refuses anything but public
+// unicast addresses, checked on the address actually dialed so neither DNS tricks nor
+// redirects can reach the server's own network.
+var urlFetchClient = &http.Client{
+	Timeout: urlFetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip, err := netip.ParseAddr(host); err != nil || !isPublicIP(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= urlFetchMaxRedirects {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("redirect to unsupported scheme")
+		}
+		return nil
+	},
+}
+
+// nonPublicPrefixes are the ranges a URL fetch may not reach: the IANA IPv4 and IPv6
+// special-purpose address registries, plus multicast. IPv6 ranges that embed an IPv4 address
+// (NAT64, 6to4, Teredo, IPv4-compatible) are refused whole rather than decoded.
+var nonPublicPrefixes = func() []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range []string{
+		"0.0.0.0/8",       // "this network"
+		"10.0.0.0/8",      // private
+		"100.64.0.0/10",   // carrier-grade NAT
+		"127.0.0.0/8",     // loopback
+		"169.254.0.0/16",  // link-local
+		"172.16.0.0/12",   // private
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation
+		"192.88.99.0/24",  // 6to4 relay anycast
+		"192.168.0.0/16",  // private
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation
+		"203.0.113.0/24",  // documentation
+		"224.0.0.0/4",     // multicast
+		"240.0.0.0/4",     // reserved, and broadcast
+		"::/96",           // unspecified, loopback and IPv4-compatible
+		"64:ff9b::/96",    // NAT64
+		"64:ff9b:1::/48",  // local-use NAT64
+		"100::/64",        // discard-only
+		"2001::/23",       // IETF protocol assignments, Teredo among them
+		"2001:db8::/32",   // documentation
+		"2002::/16",       // 6to4
+		"fc00::/7",        // unique local
+		"fe80::/10",       // link-local
+		"fec0::/10",       // site-local
+		"ff00::/8",        // multicast
+	} {
+		out = append(out, netip.MustParsePrefix(p))
+	}
+	return out
+}()
+
+// isPublicIP reports whether ip is a globally routable unicast address. IPv4-mapped IPv6
+// addresses are judged as the IPv4 address they carry.
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadURLRequest is the body of POST /upload/url.
+type uploadURLRequest struct {
+	URL        string `json:"url"`
+	Cat        string `json:"cat"`         // optional, as for /upload
+	Caption    string `json:"caption"`     // optional, as for /upload
+	UploadedBy string `json:"uploaded_by"` // optional, as for /upload
+	Album      string `json:"album"`       // optional, as for /upload
+}
+
+// handleUploadURL fetches an image or video from a public http(s) URL and stores it exactly
+// like /upload. The usual size limits apply to the download, and the stored type is sniffed
+// from the bytes whatever the remote server claims.
+func (s *server) handleUploadURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	if !requireUploadToken(w, r) {
+		return
+	}
+	if !s.allowUpload(w, r) {
+		return
+	}
+	s.setUploadLimitHeaders(w)
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	var req uploadURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON body"))
+		return
+	}
+	src, err := url.Parse(req.URL)
+	if err != nil || (src.Scheme != "http" && src.Scheme != "https") || src.Host == "" {
+		handleError(w, newError(ErrValidation, "url must be an absolute http or https URL"))
+		return
+	}
+	details, err := parsePhotoDetails(req.Caption, req.Cat, req.UploadedBy)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	album, err := parseAlbum(req.Album)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	data, contentType, err := s.fetchUpload(r.Context(), src)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+	up := upload{
+		filename:    path.Base(src.Path),
+		contentType: contentType,
+		body:        bytes.NewReader(data),
+		size:        int64(len(data)),
+		details:     details,
+		album:       album,
+	}
+	if details.cat != "" {
+		up.meta = map[string]string{catMetaName: details.cat}
+	}
+	log.Printf("upload by url: url=%s size=%d", src.Redacted(), len(data))
+	s.storeUpload(r.Context(), w, up)
+}
+
+// fetchUpload downloads src, up to the video upload limit, returning the body and its
+// declared content type.
+func (s *server) fetchUpload(ctx context.Context, src *url.URL) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.String(), nil)
+	if err != nil {
+		return nil, "", newError(ErrValidation, "invalid url")
+	}
+	req.Header.Set("Accept", "image/*, video/*")
+	resp, err := urlFetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			return nil, "", newError(ErrValidation, "url must point to a public address")
+		}
+		return nil, "", wrapError(ErrUpstream, "could not fetch url", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", newError(ErrUpstream, fmt.Sprintf("fetching url returned %s", resp.Status))
+	}
+	limit := max(s.maxUploadBytes, s.maxVideoUploadBytes)
+	if resp.ContentLength > limit {
+		return nil, "", errUploadTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", wrapError(ErrUpstream, "could not fetch url", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, "", errUploadTooLarge
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"0.1.2.3", false},
+		{"10.0.0.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"192.0.0.8", false},
+		{"192.168.1.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+		{"2001::1", false},
+		{"fd00::1", false},
+		{"fe80::1%eth0", false},
+		{"ff02::1", false},
+	} {
+		if got := isPublicIP(netip.MustParseAddr(tc.addr)); got != tc.public {
+			t.Errorf("isPublicIP(%s) = %t, want %t", tc.addr, got, tc.public)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// UPLOAD_OVERWRITE modes: what an upload to a key that already exists does.
+const (
+	overwriteReject  = "reject"  // refuse it with a 409; the default
+	overwriteVersion = "version" // replace the object; bucket versioning keeps the old one
+)
+
+var errKeyExists = newError(ErrConflict, "a photo with this key already exists")
+
+func parseUploadOverwrite(v string) (string, error) {
+	switch v {
+	case "":
+		return overwriteReject, nil
+	case overwriteReject, overwriteVersion:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want reject or version)", v)
+}
+
+// checkBucketVersioning warns when UPLOAD_OVERWRITE=version is set on a bucket that won't
+// keep the replaced objects. R2 doesn't implement versioning at all.
+func (s *server) checkBucketVersioning(ctx context.Context) {
+	out, err := s.s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(s.bucket)})
+	if err != nil {
+		log.Printf("UPLOAD_OVERWRITE=version: could not read bucket versioning, overwritten photos may be lost: %v", err)
+		return
+	}
+	if out.Status != types.BucketVersioningStatusEnabled {
+		log.Printf("UPLOAD_OVERWRITE=version: versioning is not enabled on bucket %s, overwritten photos will be lost", s.bucket)
+	}
+}
+
+// uploadIfNoneMatch is the If-None-Match condition for writing an upload: "*" when
+// overwrites are refused, so R2 rejects a write to an existing key atomically.
+func (s *server) uploadIfNoneMatch() *string {
+	if s.uploadOverwrite == overwriteReject {
+		return aws.String("*")
+	}
+	return nil
+}
+
+// checkKeyFree fails with errKeyExists when overwrites are refused and key is already in the
+// bucket. Direct uploads check up front so a client isn't handed a URL that can only fail;
+// the write itself is conditional too.
+func (s *server) checkKeyFree(ctx context.Context, key string) error {
+	if s.uploadOverwrite != overwriteReject {
+		return nil
+	}
+	_, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	switch {
+	case err == nil:
+		return errKeyExists
+	case errors.As(err, &notFound):
+		return nil
+	default:
+		return s.r2Error("upload check failed", err)
+	}
+}
+
+// isPreconditionFailed reports whether an R2 write failed its If-None-Match condition.
+func isPreconditionFailed(err error) bool {
+	var re *awshttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == http.StatusPreconditionFailed
+}
+
+// photoVersion is one stored version of a photo in GET /photos/{key}/versions.
+type photoVersion struct {
+	VersionID string `json:"version_id"`
+	Modified  string `json:"modified"`
+	Size      int64  `json:"size"`
+	Latest    bool   `json:"latest"`
+}
+
+// handlePhotoVersions serves GET /photos/{key}/versions: the photo's stored versions, newest
+// first. It's only available with UPLOAD_OVERWRITE=version.
+func (s *server) handlePhotoVersions(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.uploadOverwrite != overwriteVersion {
+		handleError(w, newError(ErrNotFound, "versioning is not enabled"))
+		return
+	}
+	versions := []photoVersion{}
+	p := s3.NewListObjectVersionsPaginator(s.s3Client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.keyBucket(key)),
+		Prefix: aws.String(key),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(r.Context())
+		if err != nil {
+			handleError(w, s.r2Error("could not list versions", err))
+			return
+		}
+		for _, v := range out.Versions {
+			if aws.ToString(v.Key) != key {
+				continue
+			}
+			versions = append(versions, photoVersion{
+				VersionID: aws.ToString(v.VersionId),
+				Modified:  aws.ToTime(v.LastModified).UTC().Format(time.RFC3339),
+				Size:      aws.ToInt64(v.Size),
+				Latest:    aws.ToBool(v.IsLatest),
+			})
+		}
+	}
+	if len(versions) == 0 {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "versions": versions})
+}
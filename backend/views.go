@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	defaultTrendingLimit  = 10
+	maxTrendingLimit      = 100
+)
+
+// viewCounter counts /feed serves per photo in hourly buckets (photo_views) for
+// /photos/trending. Serves are tallied in memory and written in batches by run, so a crash
+// loses at most one flush interval of counts.
+type viewCounter struct {
+	db        *sql.DB
+	retention time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int64
+}
+
+// newViewCounter creates the photo_views table if needed. Buckets older than retention are
+// pruned by run.
+func newViewCounter(ctx context.Context, db *sql.DB, retention time.Duration) (*viewCounter, error) {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS photo_views (
+			photo_key TEXT NOT NULL,
+			hour TIMESTAMPTZ NOT NULL,
+			views BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (photo_key, hour)
+		);
+		CREATE INDEX IF NOT EXISTS photo_views_hour ON photo_views (hour);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return &viewCounter{db: db, retention: retention, pending: make(map[string]int64)}, nil
+}
+
+// add counts one view of each of keys.
+func (c *viewCounter) add(keys []string) {
+	c.mu.Lock()
+	for _, k := range keys {
+		c.pending[k]++
+	}
+	c.mu.Unlock()
+}
+
+// flush writes the pending counts into the current hour's bucket. On failure they're put back
+// to be retried with the next flush.
+func (c *viewCounter) flush(ctx context.Context) error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]int64)
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(pending))
+	counts := make([]int64, 0, len(pending))
+	for k, n := range pending {
+		keys = append(keys, k)
+		counts = append(counts, n)
+	}
+	_, err := c.db.ExecContext(ctx, `
+		INSERT INTO photo_views (photo_key, hour, views)
+		SELECT k, date_trunc('hour', NOW()), n FROM unnest($1::text[], $2::bigint[]) AS t(k, n)
+		ON CONFLICT (photo_key, hour) DO UPDATE SET views = photo_views.views + EXCLUDED.views
+	`, pq.Array(keys), pq.Array(counts))
+	if err != nil {
+		c.mu.Lock()
+		for k, n := range pending {
+			c.pending[k] += n
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// run flushes every interval and prunes expired buckets hourly, until the process exits.
+func (c *viewCounter) run(interval time.Duration) {
+	flushTick := time.NewTicker(interval)
+	pruneTick := time.NewTicker(time.Hour)
+	for {
+		select {
+		case <-flushTick.C:
+			if err := c.flush(context.Background()); err != nil {
+				log.Printf("view counts flush: %v", err)
+			}
+		case <-pruneTick.C:
+			if _, err := c.db.Exec(`DELETE FROM photo_views WHERE hour < $1`, time.Now().Add(-c.retention)); err != nil {
+				log.Printf("view counts prune: %v", err)
+			}
+		}
+	}
+}
+
+// forget drops the counts of deleted photos, flushed or not.
+func (c *viewCounter) forget(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	for _, k := range keys {
+		delete(c.pending, k)
+	}
+	c.mu.Unlock()
+	_, err := c.db.ExecContext(ctx, `DELETE FROM photo_views WHERE photo_key = ANY($1)`, pq.Array(keys))
+	return err
+}
+
+// photoViews is one row of a trending query.
+type photoViews struct {
+	key   string
+	views int64
+}
+
+// top returns up to limit photos by views since the given time, most viewed first with ties
+// broken by key. Buckets are hourly, so the window is rounded out to the hour.
+func (c *viewCounter) top(ctx context.Context, since time.Time, limit int) ([]photoViews, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT photo_key, SUM(views) AS total FROM photo_views
+		WHERE hour >= date_trunc('hour', $1::timestamptz)
+		GROUP BY photo_key
+		ORDER BY total DESC, photo_key
+		LIMIT $2
+	`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []photoViews
+	for rows.Next() {
+		var pv photoViews
+		if err := rows.Scan(&pv.key, &pv.views); err != nil {
+			return nil, err
+		}
+		out = append(out, pv)
+	}
+	return out, rows.Err()
+}
+
+// handleTrending returns the most-served photos over window (a Go duration, default 24h,
+// at most the retention period) as /feed items with a views count each. Counts lag by up to
+// one flush interval. Accepts fields like /feed.
+func (s *server) handleTrending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.views == nil {
+		handleError(w, newError(ErrUnavailable, "view counting is disabled"))
+		return
+	}
+	q := r.URL.Query()
+	window := defaultTrendingWindow
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Hour || d > s.views.retention {
+			handleError(w, newError(ErrValidation, "window must be a duration between 1h and "+s.views.retention.String()))
+			return
+		}
+		window = d
+	}
+	limit := defaultTrendingLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxTrendingLimit {
+			handleError(w, newError(ErrValidation, "limit must be between 1 and "+strconv.Itoa(maxTrendingLimit)))
+			return
+		}
+		limit = n
+	}
+	fields, err := parseFeedFields(q)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	// Over-fetch since hidden photos keep their counts but aren't in the index.
+	top, err := s.views.top(r.Context(), time.Now().Add(-window), limit*2)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "trending query failed", err))
+		return
+	}
+	urls := make([]string, 0, limit)
+	views := make([]int64, 0, limit)
+	s.feedByKeyMu.RLock()
+	for _, pv := range top {
+		if u, ok := s.feedByKey[pv.key]; ok && len(urls) < limit {
+			urls = append(urls, u)
+			views = append(views, pv.views)
+		}
+	}
+	s.feedByKeyMu.RUnlock()
+
+	resp := s.feedResponse(urls, fields)
+	for i, item := range resp["items"].([]map[string]interface{}) {
+		item["views"] = views[i]
+	}
+	resp["window"] = window.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// virusScanTimeout bounds one scan.
+const virusScanTimeout = 60 * time.Second
+
+// clamdChunkSize is how much of a file goes in each INSTREAM chunk.
+const clamdChunkSize = 64 << 10
+
+// virusScanner checks uploads for malware (VIRUS_SCAN).
+type virusScanner interface {
+	// scan returns the name of the signature data matched, or "" when it's clean.
+	scan(ctx context.Context, key string, data []byte) (signature string, err error)
+}
+
+// newVirusScanner builds the scanner for VIRUS_SCAN ("clamav" or "webhook"), or returns nil
+// when it's unset.
+func newVirusScanner() (virusScanner, error) {
+	switch name := os.Getenv("VIRUS_SCAN"); name {
+	case "":
+		return nil, nil
+	case "clamav":
+		return &clamdScanner{addr: envOr("CLAMD_ADDR", "localhost:3310")}, nil
+	case "webhook":
+		u := os.Getenv("VIRUS_SCAN_WEBHOOK_URL")
+		if u == "" {
+			return nil, fmt.Errorf("VIRUS_SCAN_WEBHOOK_URL must be set")
+		}
+		return &webhookScanner{url: u, secret: []byte(os.Getenv("VIRUS_SCAN_WEBHOOK_SECRET"))}, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner %q (want clamav or webhook)", name)
+	}
+}
+
+// scanUpload scans an upload before it's written to the bucket and rewinds body. A positive
+// is rejected with the signature logged; a scan that can't run rejects the upload too, so
+// nothing is stored unscanned.
+func (s *server) scanUpload(ctx context.Context, key string, body io.ReadSeeker) error {
+	if s.virusScanner == nil {
+		return nil
+	}
+	data, err := io.ReadAll(body)
+	if _, serr := body.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return wrapError(ErrInternal, "could not read upload", errors.Join(err, serr))
+	}
+	return s.scanData(ctx, key, data)
+}
+
+func (s *server) scanData(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, virusScanTimeout)
+	defer cancel()
+	signature, err := s.virusScanner.scan(ctx, key, data)
+	if err != nil {
+		log.Printf("virus scan: key=%s err=%v", key, err)
+		return wrapError(ErrUnavailable, "virus scan unavailable, try again later", err)
+	}
+	if signature != "" {
+		log.Printf("virus scan positive: key=%s signature=%s", key, signature)
+		return newError(ErrUnprocessable, "upload rejected: the file failed a virus scan")
+	}
+	return nil
+}
+
+// clamdScanner streams files to clamd over TCP with the INSTREAM command.
+type clamdScanner struct {
+	addr string
+}
+
+func (c *clamdScanner) scan(ctx context.Context, key string, data []byte) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), clamdChunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+	reply = strings.TrimSuffix(reply, "\x00")
+	switch {
+	case reply == "stream: OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// webhookScanner POSTs each file to a URL that scans it, signed like webhookModerator. The
+// response is JSON: {"clean": bool, "signature": "..."}.
+type webhookScanner struct {
+	url    string
+	secret []byte
+}
+
+func (m *webhookScanner) scan(ctx context.Context, key string, data []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Photo-Key", key)
+	if len(m.secret) > 0 {
+		mac := hmac.New(sha256.New, m.secret)
+		mac.Write(data)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("scan webhook: %s", resp.Status)
+	}
+	var out struct {
+		Clean     bool   `json:"clean"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out); err != nil {
+		return "", fmt.Errorf("scan webhook: %w", err)
+	}
+	if out.Clean {
+		return "", nil
+	}
+	if out.Signature == "" {
+		out.Signature = "unknown"
+	}
+	return out.Signature, nil
+}
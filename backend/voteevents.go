@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// createVoteEventsTable creates the append-only log of every vote. votes only keeps each
+// client's latest choice; this keeps the ones before it too.
+func createVoteEventsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS vote_events (
+			id BIGSERIAL PRIMARY KEY,
+			key TEXT NOT NULL,
+			namu_is_tuxedo BOOLEAN,
+			previous BOOLEAN,
+			reason TEXT,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS vote_events_key_idx ON vote_events (key, created_at);
+	`)
+	return err
+}
+
+// lockVoteKey serializes vote changes for key until tx ends. A row lock isn't enough: there's
+// no row to lock before a client's first vote, and two racing first votes would both be
+// logged with no previous choice.
+func lockVoteKey(ctx context.Context, tx *sql.Tx, key string) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	return nil
+}
+
+// recordVote stores key's vote and appends it, with the choice it replaced, to vote_events,
+// in one transaction.
+func (s *server) recordVote(ctx context.Context, key string, isTuxedo bool, reason string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockVoteKey(ctx, tx, key); err != nil {
+		return err
+	}
+	var previous sql.NullBool
+	err = tx.QueryRowContext(ctx, `SELECT namu_is_tuxedo FROM votes WHERE key = $1`, key).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("previous: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO votes (key, namu_is_tuxedo, vote_count, reason) VALUES ($1, $2, 1, NULLIF($3, ''))
+		 ON CONFLICT (key) DO UPDATE SET namu_is_tuxedo = $2, updated_at = NOW(), vote_count = votes.vote_count + 1, reason = NULLIF($3, '')`,
+		key, isTuxedo, reason); err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_events (key, namu_is_tuxedo, previous, reason) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+		key, isTuxedo, previous, reason); err != nil {
+		return fmt.Errorf("event: %w", err)
+	}
+	return tx.Commit()
+}
+
+// retractVote deletes key's vote and logs the retraction to vote_events as an event with no
+// choice, reporting false if there was no vote to retract.
+func (s *server) retractVote(ctx context.Context, key string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := lockVoteKey(ctx, tx, key); err != nil {
+		return false, err
+	}
+	var previous bool
+	err = tx.QueryRowContext(ctx, `DELETE FROM votes WHERE key = $1 RETURNING namu_is_tuxedo`, key).Scan(&previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("delete: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO vote_events (key, namu_is_tuxedo, previous) VALUES ($1, NULL, $2)`,
+		key, previous); err != nil {
+		return false, fmt.Errorf("event: %w", err)
+	}
+	return true, tx.Commit()
+}
+
+// voteEvent is one entry in GET /votes/{key}/history. Previous is absent for a first vote,
+// and NamuIsTuxedo is null for a retraction.
+type voteEvent struct {
+	NamuIsTuxedo *bool     `json:"namu_is_tuxedo"`
+	Previous     *bool     `json:"previous,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// handleVotes serves /votes/{key}/history: every vote the client key has cast, oldest first,
+// so flip-flopping can be looked at (admin only). ?limit caps how many, keeping the latest.
+func (s *server) handleVotes(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/votes/"), "/history")
+	if !ok || key == "" {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT namu_is_tuxedo, previous, COALESCE(reason, ''), created_at FROM (
+			SELECT * FROM vote_events WHERE key = $1 ORDER BY id DESC LIMIT $2
+		) latest
+		ORDER BY id
+	`, key, limit)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "vote history failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	defer rows.Close()
+	events := []voteEvent{}
+	for rows.Next() {
+		var ev voteEvent
+		var choice, previous sql.NullBool
+		if err := rows.Scan(&choice, &previous, &ev.Reason, &ev.CreatedAt); err != nil {
+			handleError(w, wrapError(ErrInternal, "vote history failed", fmt.Errorf("scan: %w", err)))
+			return
+		}
+		if choice.Valid {
+			ev.NamuIsTuxedo = &choice.Bool
+		}
+		if previous.Valid {
+			ev.Previous = &previous.Bool
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		handleError(w, wrapError(ErrInternal, "vote history failed", fmt.Errorf("rows: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "events": events})
+}
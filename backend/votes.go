@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MAX_REASON_LEN caps the optional free-text vote reason, in characters.
+const MAX_REASON_LEN = 280
+
+// voteRequest is the JSON body for POST /vote.
+type voteRequest struct {
+	Key          string `json:"key"`            // client identifier (who is voting)
+	NamuIsTuxedo bool   `json:"namu_is_tuxedo"` // true if voter thinks namu is the tuxedo cat
+	Reason       string `json:"reason"`         // optional free-text explanation, truncated to MAX_REASON_LEN
+}
+
+// handleVote serves /vote: POST casts or changes a vote and DELETE retracts one.
+func (s *server) handleVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		s.handleRetractVote(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON"))
+		return
+	}
+	if req.Key == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return
+	}
+	if allowed, retry := s.voteIPLimiter.allow(clientIP(r), req.Key); !allowed {
+		log.Printf("vote rejected: too many keys from ip=%s key=%s", clientIP(r), req.Key)
+		handleError(w, retryError(ErrRateLimited, "too many votes from this network", retry))
+		return
+	}
+	if err := s.recordVote(context.Background(), req.Key, req.NamuIsTuxedo, sanitizeReason(req.Reason)); err != nil {
+		handleError(w, wrapError(ErrInternal, "vote failed", err))
+		return
+	}
+	s.publishConsensus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ok": "voted"})
+}
+
+// handleRetractVote serves DELETE /vote (body: {"key": ...}): it removes the client's vote,
+// so it no longer counts toward /consensus, for voters who'd rather abstain than switch.
+func (s *server) handleRetractVote(w http.ResponseWriter, r *http.Request) {
+	if s.rejectIfMaintenance(w) {
+		return
+	}
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, newError(ErrValidation, "invalid JSON"))
+		return
+	}
+	if req.Key == "" {
+		handleError(w, newError(ErrValidation, "key required"))
+		return
+	}
+	retracted, err := s.retractVote(r.Context(), req.Key)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "retract failed", err))
+		return
+	}
+	if !retracted {
+		handleError(w, newError(ErrNotFound, "no vote for this key"))
+		return
+	}
+	s.publishConsensus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ok": "retracted"})
+}
+
+// storedVote is a client's current vote, as returned by GET /vote/{key}.
+type storedVote struct {
+	Key          string    `json:"key"`
+	NamuIsTuxedo bool      `json:"namu_is_tuxedo"`
+	VoteCount    int64     `json:"vote_count"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// handleVoteByKey serves GET /vote/{key}: the client's current vote, so a returning client
+// can show its earlier answer. 404 if the key has never voted.
+func (s *server) handleVoteByKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/vote/")
+	if key == "" {
+		handleError(w, newError(ErrNotFound, "not found"))
+		return
+	}
+	v := storedVote{Key: key}
+	err := s.db.QueryRowContext(r.Context(), `
+		SELECT namu_is_tuxedo, vote_count, updated_at FROM votes WHERE key = $1
+	`, key).Scan(&v.NamuIsTuxedo, &v.VoteCount, &v.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, newError(ErrNotFound, "no vote for this key"))
+		return
+	}
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "vote lookup failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *server) handleConsensus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	c, err := s.consensusCounts(context.Background())
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "consensus failed", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// consensus is the vote tally returned by /consensus and sent as consensus_changed. The
+// total and percentages are filled in by withTotals.
+type consensus struct {
+	NamuIsTuxedo    int64   `json:"namu_is_tuxedo"`
+	NamuIsNotTuxedo int64   `json:"namu_is_not_tuxedo"`
+	TotalVoters     int64   `json:"total_voters"`
+	TuxedoPct       float64 `json:"tuxedo_pct"`
+	NotTuxedoPct    float64 `json:"not_tuxedo_pct"`
+}
+
+// withTotals returns c with the total and percentages set. Percentages are rounded to one
+// decimal place and add up to 100, or are both 0 when nobody has voted.
+func (c consensus) withTotals() consensus {
+	c.TotalVoters = c.NamuIsTuxedo + c.NamuIsNotTuxedo
+	c.TuxedoPct, c.NotTuxedoPct = 0, 0
+	if c.TotalVoters > 0 {
+		c.TuxedoPct = math.Round(float64(c.NamuIsTuxedo)*1000/float64(c.TotalVoters)) / 10
+		c.NotTuxedoPct = math.Round((100-c.TuxedoPct)*10) / 10
+	}
+	return c
+}
+
+func (s *server) consensusCounts(ctx context.Context) (consensus, error) {
+	var c consensus
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT namu_is_tuxedo, COUNT(*) AS cnt
+		FROM votes
+		GROUP BY namu_is_tuxedo
+	`)
+	if err != nil {
+		return c, fmt.Errorf("query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var isTuxedo bool
+		var cnt int64
+		if err := rows.Scan(&isTuxedo, &cnt); err != nil {
+			return c, fmt.Errorf("scan: %w", err)
+		}
+		if isTuxedo {
+			c.NamuIsTuxedo = cnt
+		} else {
+			c.NamuIsNotTuxedo = cnt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return c, fmt.Errorf("rows: %w", err)
+	}
+	return c.withTotals(), nil
+}
+
+// publishConsensus sends the current tally to live clients after a vote. A failed count
+// only costs them one update, so it's logged rather than failing the vote.
+func (s *server) publishConsensus(ctx context.Context) {
+	if !s.events.hasSubscribers() {
+		return
+	}
+	c, err := s.consensusCounts(ctx)
+	if err != nil {
+		log.Printf("consensus publish: %v", err)
+		return
+	}
+	s.events.publish(hubEvent{Type: eventConsensusChanged, Data: c})
+}
+
+// handleConsensusExport streams every vote row as CSV (admin only).
+func (s *server) handleConsensusExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT key, namu_is_tuxedo, vote_count, created_at, updated_at
+		FROM votes
+		ORDER BY created_at
+	`)
+	if err != nil {
+		handleError(w, wrapError(ErrInternal, "export failed", fmt.Errorf("query: %w", err)))
+		return
+	}
+	defer rows.Close()
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="votes-%s.csv"`, time.Now().Format("2006-01-02")))
+	// Rows are streamed straight from the cursor; once the header is written,
+	// errors can only be logged.
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "namu_is_tuxedo", "vote_count", "created_at", "updated_at"})
+	for rows.Next() {
+		var key string
+		var isTuxedo bool
+		var count int64
+		var createdAt, updatedAt time.Time
+		if err := rows.Scan(&key, &isTuxedo, &count, &createdAt, &updatedAt); err != nil {
+			log.Printf("export scan: %v", err)
+			break
+		}
+		cw.Write([]string{
+			key,
+			strconv.FormatBool(isTuxedo),
+			strconv.FormatInt(count, 10),
+			createdAt.UTC().Format(time.RFC3339),
+			updatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("export rows: %v", err)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("export write: %v", err)
+	}
+}
+
+// sanitizeReason drops control characters, collapses surrounding whitespace and
+// truncates the reason to MAX_REASON_LEN characters.
+func sanitizeReason(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if r := []rune(s); len(r) > MAX_REASON_LEN {
+		s = strings.TrimSpace(string(r[:MAX_REASON_LEN]))
+	}
+	return s
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// A failed delivery is retried after webhookRetryBase, doubling each time up to
+	// webhookRetryMax.
+	webhookRetryBase = 2 * time.Second
+	webhookRetryMax  = 5 * time.Minute
+)
+
+// webhookSender POSTs events to the WEBHOOK_URLS, each delivery in its own goroutine. Bodies
+// are the hubEvent JSON /feed/stream sends, signed like the moderation webhook: with
+// WEBHOOK_SECRET set, X-Signature is the hex HMAC-SHA256 of the body. Discord webhook URLs
+// get a Discord message instead. Failures (network errors, 429s and 5xxs) are retried with
+// exponential backoff up to WEBHOOK_MAX_ATTEMPTS; pending retries don't survive a restart.
+type webhookSender struct {
+	urls        []string
+	secret      []byte
+	maxAttempts int
+	client      *http.Client
+}
+
+// newWebhookSender returns the sender for WEBHOOK_URLS (comma-separated), or nil when unset.
+func newWebhookSender() (*webhookSender, error) {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", u)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	return &webhookSender{
+		urls:        urls,
+		secret:      []byte(os.Getenv("WEBHOOK_SECRET")),
+		maxAttempts: max(envInt("WEBHOOK_MAX_ATTEMPTS", 5), 1),
+		client:      &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// send delivers ev to every URL in the background.
+func (h *webhookSender) send(ev hubEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("webhook encode: type=%s err=%v", ev.Type, err)
+		return
+	}
+	for _, u := range h.urls {
+		b := body
+		if isDiscordWebhook(u) {
+			if b, err = discordMessage(ev); err != nil {
+				log.Printf("webhook encode: type=%s err=%v", ev.Type, err)
+				continue
+			}
+		}
+		go h.deliver(u, ev.Type, b)
+	}
+}
+
+// deliver POSTs body to u until it's accepted or maxAttempts run out.
+func (h *webhookSender) deliver(u, event string, body []byte) {
+	delay := webhookRetryBase
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := h.post(u, event, body)
+		if err == nil {
+			return
+		}
+		if retryAfter < 0 || attempt == h.maxAttempts {
+			log.Printf("webhook failed: url=%s type=%s attempts=%d err=%v", redactURL(u), event, attempt, err)
+			return
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay/2)))
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		log.Printf("webhook retry: url=%s type=%s attempt=%d wait=%s err=%v", redactURL(u), event, attempt, wait, err)
+		time.Sleep(wait)
+		delay = min(delay*2, webhookRetryMax)
+	}
+}
+
+// post makes one delivery attempt. On failure retryAfter is how long the receiver asked us
+// to wait (0 if it didn't say), or negative when retrying won't help.
+func (h *webhookSender) post(u, event string, body []byte) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(secs) * time.Second, fmt.Errorf("status %s", resp.Status)
+	}
+	return -1, fmt.Errorf("status %s", resp.Status)
+}
+
+// isDiscordWebhook reports whether u is a Discord channel webhook, which takes its own
+// message format rather than our events.
+func isDiscordWebhook(u string) bool {
+	p, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(p.Hostname(), "www.")
+	return (host == "discord.com" || host == "discordapp.com") && strings.HasPrefix(p.Path, "/api/webhooks/")
+}
+
+// discordMessage renders a photo_added event as a Discord message: the caption, if any, and
+// the photo's URL, which Discord embeds. Other events are sent as their type.
+func discordMessage(ev hubEvent) ([]byte, error) {
+	content := ev.Type
+	if item, ok := ev.Data.(map[string]interface{}); ok && ev.Type == eventPhotoAdded {
+		u, _ := item["url"].(string)
+		content = u
+		if c, _ := item["caption"].(string); c != "" {
+			content = c + "\n" + u
+		}
+	}
+	return json.Marshal(map[string]string{"content": content})
+}
+
+// redactURL drops the path and query from a webhook URL for logging, since a Discord
+// webhook's path is its credential.
+func redactURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return "?"
+	}
+	return p.Scheme + "://" + p.Host
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// widgetPage is the iframe body for /widget: it fetches /widget?format=json every interval
+// and swaps the photo in, so it needs nothing from the embedding page.
+var widgetPage = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Namu &amp; Rocky</title>
+<style>
+html,body{margin:0;height:100%;background:#000;overflow:hidden}
+img,video{width:100%;height:100%;object-fit:{{.Fit}};display:block}
+</style></head>
+<body><div id="photo"></div>
+<script>
+(function(){
+  var box = document.getElementById("photo");
+  function show(){
+    fetch("widget?format=json", {cache: "no-store"}).then(function(r){ return r.ok ? r.json() : null; }).then(function(item){
+      if (!item) return;
+      var el = document.createElement(item.type === "video" ? "video" : "img");
+      if (item.type === "video") { el.autoplay = el.muted = el.loop = el.playsInline = true; }
+      el.alt = "Namu & Rocky";
+      el.src = item.url;
+      box.replaceChildren(el);
+    }).catch(function(){});
+  }
+  show();
+  setInterval(show, {{.Interval}} * 1000);
+})();
+</script></body></html>
+`))
+
+// handleWidget serves an embeddable page showing a random photo that changes every
+// interval seconds (default 15, 3-3600); fit=contain letterboxes instead of cropping. With
+// format=json it returns one random /feed item instead, which is what the page polls. Nothing
+// is tracked per viewer, so repeats are possible.
+func (s *server) handleWidget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		handleError(w, errMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("format") == "json" {
+		entries := s.feedList()
+		if len(entries) == 0 {
+			handleError(w, newError(ErrNotFound, "no photos"))
+			return
+		}
+		s.requestSeenMu.Lock()
+		u := entries[s.rng.Intn(len(entries))].url
+		s.requestSeenMu.Unlock()
+		item := s.feedResponse([]string{u}, nil)["items"].([]map[string]interface{})[0]
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(item)
+		return
+	}
+
+	interval := 15
+	if v := q.Get("interval"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 3 || n > 3600 {
+			handleError(w, newError(ErrValidation, "interval must be between 3 and 3600 seconds"))
+			return
+		}
+		interval = n
+	}
+	fit := "cover"
+	if q.Get("fit") == "contain" {
+		fit = "contain"
+	}
+	// frame-ancestors is what allows (or limits) embedding; X-Frame-Options is deliberately
+	// not set since it can't express a list of sites.
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+s.widgetFrameAncestors+"; default-src 'none'; img-src * data:; media-src *; connect-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	widgetPage.Execute(w, struct {
+		Interval int
+		Fit      string
+	}{interval, fit})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsWriteTimeout bounds each message write, so a client that stops reading is disconnected
+// instead of holding its subscription forever.
+const wsWriteTimeout = 10 * time.Second
+
+// handleWS upgrades to a WebSocket that carries every hub event as a typed JSON message,
+// {"type": "photo_added"|"consensus_changed", "data": ...}. Messages from the client are
+// ignored.
+func (s *server) handleWS(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 1 {
+		// The upgrade hijacks the connection, which HTTP/2 (h2c) doesn't allow.
+		handleError(w, newError(ErrValidation, "websocket requires HTTP/1.1"))
+		return
+	}
+	websocket.Server{Handler: s.serveWS}.ServeHTTP(w, r)
+}
+
+// serveWS is the per-connection write pump. Slow clients are handled in two places: the
+// hub drops events for a subscriber whose buffer is full, and a write that exceeds
+// wsWriteTimeout closes the connection so the client reconnects and refetches.
+func (s *server) serveWS(conn *websocket.Conn) {
+	defer conn.Close()
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	// Reading is what notices the client going away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var msg string
+		for websocket.Message.Receive(conn, &msg) == nil {
+		}
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case ev := <-events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := websocket.JSON.Send(conn, ev); err != nil {
+				log.Printf("websocket send: type=%s err=%v", ev.Type, err)
+				return
+			}
+		}
+	}
+}